@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"os"
+)
+
+// The secrets come from the environment, so they stay out of the command line and the shell history
+const (
+	userEnv     = "SAFE_UDP_USER"
+	passwordEnv = "SAFE_UDP_PASSWORD"
+	tokenEnv    = "SAFE_UDP_TOKEN"
+)
+
+// authFlags registers the flag of the user to authenticate as, and takes the secrets from the environment
+func authFlags(fs *flag.FlagSet, opts *Options) {
+	fs.StringVar(&opts.User, "user", os.Getenv(userEnv), "user to authenticate as, with the password in $"+passwordEnv+"; $"+tokenEnv+" authenticates with an API token instead")
+	opts.Password = os.Getenv(passwordEnv)
+	opts.APIToken = os.Getenv(tokenEnv)
+}
+
+// sendRequest sends the request along with our credentials
+func (c *Client) sendRequest(request *model.Request) error {
+	c.authenticate(request)
+	return c.tcpConn.SendRequest(request)
+}
+
+// authenticate adds our credentials to the request
+func (c *Client) authenticate(request *model.Request) {
+	if c.opts.APIToken != "" {
+		request.APIToken = c.opts.APIToken
+	} else if c.opts.User != "" {
+		request.User, request.Password = c.opts.User, c.opts.Password
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/transfer"
+	"github.com/gtxistxgao/safe-udp/common/udp_client"
+	"net"
+	"strings"
+	"time"
+)
+
+// source is a local address to send from
+type source struct {
+	ip     string
+	device string // interface the sockets are bound to, empty when an IP was given
+}
+
+// sources resolves the bind addresses to send from, none means the default route
+func (c *Client) sources() ([]source, error) {
+	if len(c.opts.Bind) == 0 {
+		return nil, nil
+	}
+
+	return bindAddresses(c.opts.Bind, strings.Contains(c.host, ":"))
+}
+
+// addresses are the IPs of the sources, the server takes chunks from them
+func addresses(sources []source) []string {
+	ips := make([]string, 0, len(sources))
+	for _, s := range sources {
+		ips = append(ips, s.ip)
+	}
+
+	return ips
+}
+
+// dialPaths creates the UDP clients of every path to the ports of the server: one path per source, or the
+// default route when there is none
+func (c *Client) dialPaths(ports []string, sources []source) ([]*transfer.Path, error) {
+	if len(sources) == 0 {
+		sources = []source{{}}
+	}
+
+	paths := make([]*transfer.Path, 0, len(sources))
+	for _, s := range sources {
+		clients, err := udp_client.DialAll(c.ctx, s.ip, s.device, c.host, ports, time.Second*2)
+		if err != nil {
+			for _, p := range paths {
+				p.Close()
+			}
+			return nil, err
+		}
+
+		paths = append(paths, &transfer.Path{Local: s.ip, Clients: clients})
+	}
+
+	return paths, nil
+}
+
+// bindAddresses turns the bind arguments into sources: an IP is taken as is, an interface gives its first
+// address of the family of the server and the sockets are bound to it
+func bindAddresses(binds []string, ipv6 bool) ([]source, error) {
+	sources := make([]source, 0, len(binds))
+	for _, bind := range binds {
+		if ip := net.ParseIP(bind); ip != nil {
+			sources = append(sources, source{ip: ip.String()})
+			continue
+		}
+
+		iface, err := net.InterfaceByName(bind)
+		if err != nil {
+			return nil, fmt.Errorf("bind %q is neither an IP nor an interface: %w", bind, err)
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("fail to list the addresses of %s: %w", bind, err)
+		}
+
+		found := ""
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() == nil) != ipv6 || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			found = ipNet.IP.String()
+			break
+		}
+
+		if found == "" {
+			return nil, fmt.Errorf("interface %s has no address to reach the server from", bind)
+		}
+		sources = append(sources, source{ip: found, device: iface.Name})
+	}
+
+	return sources, nil
+}
@@ -1,316 +1,287 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
-	"github.com/gtxistxgao/safe-udp/client/tcpconn"
 	"github.com/gtxistxgao/safe-udp/common/consts"
 	"github.com/gtxistxgao/safe-udp/common/fileoperator"
-	"github.com/gtxistxgao/safe-udp/common/toggle"
-	"github.com/gtxistxgao/safe-udp/common/udp_client"
-	"github.com/gtxistxgao/safe-udp/common/util"
-	"io"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/common/pmtu"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/common/transfer"
+	"github.com/gtxistxgao/safe-udp/common/udp_server"
 	"log"
 	"net"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 )
 
-var fileName string = "book.pdf"
-
-func main() {
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
-
-	start := time.Now()
-	c := NewClient(ctx, cancel)
-	c.Run()
-
-	elapsed := time.Since(start)
-	log.Println("File sent. cost", elapsed)
-	fileMeta := c.GetFileMeta()
-	log.Println("File info", fileMeta.String())
-	log.Printf("Speed: %f Kb/s\n", float64(fileMeta.Size)/1024/elapsed.Seconds())
-	log.Printf("Speed: %f Mb/s\n", float64(fileMeta.Size)/1024/1024/elapsed.Seconds())
+// how long dialing the server again may take, when the control connection broke
+const redialTimeout = 5 * time.Second
+
+type Options struct {
+	Server string  // control address of the server as host:port
+	Dest   string  // directory to store the files in, on the server for send and locally for get
+	Rate   float64 // emit rate limit in Mbit/s, 0 means unlimited
+	Mode   string  // transfer.ModeMulti or transfer.ModeSingle
+
+	OnConflict  fileoperator.ConflictPolicy // what the receiver does with files that already exist
+	Preserve    bool                        // keep mode, times, ownership and extended attributes of the files
+	Compression string                      // consts.CompressionDeflate to compress the chunks that get smaller
+	MTU         int                         // path MTU towards the server, 0 to probe it
+	Read        fileoperator.ReadOptions    // how the files to send are read
+	Sockets     int                         // UDP sockets to stripe the chunks over, the server may allow less for send
+	Workers     int                         // go routines decoding the chunks of get, 0 runs one per CPU
+	Bind        []string                    // local addresses or interfaces send stripes the chunks over, one path each
+	Resume      time.Duration               // how long a transfer tries to reconnect once its connection broke, 0 never
+
+	User     string // user to authenticate as with Password
+	Password string
+	APIToken string // authenticates instead of User and Password
 }
 
+// Client is one session with the server
 type Client struct {
-	ctx        context.Context
-	tcpConn    *tcpconn.TcpConn
-	cancel     context.CancelFunc
-	fileReader *fileoperator.Reader
-	udpClient  *udp_client.UDPClient
+	ctx     context.Context
+	cancel  context.CancelFunc
+	host    string // server host, the UDP data path goes to the same host as the control channel
+	opts    Options
+	stats   transfer.Stats // of the last transfer
+	tcpConn *tcpconn.TcpConn
 }
 
-func NewClient(ctx context.Context, cancel context.CancelFunc) *Client {
-	// 1. setup TCP connection
-	log.Println("Start to dial server")
-	tcpConn, err := net.Dial("tcp", ":8888")
+func NewClient(ctx context.Context, cancel context.CancelFunc, opts Options) (*Client, error) {
+	host, _, err := net.SplitHostPort(opts.Server)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("invalid server address %q: %w", opts.Server, err)
 	}
 
-	// 2. create UDP client
-	udpPort, err := getUcpDstPort(tcpConn)
+	log.Println("Start to dial server")
+	conn, err := net.Dial("tcp", opts.Server)
 	if err != nil {
-		log.Fatal("Fail to send file meta data, error:", err)
+		return nil, err
 	}
 
-	udpClient := udp_client.New(ctx, "localhost:"+udpPort, time.Second*2)
-	log.Println("UDP buffer value is:", udpClient.GetBufferValue())
+	tcpConn := tcpconn.New(conn)
+	if err := tcpConn.Answer(); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
 
-	// 3. exchange File metadata
-	fileReader := fileoperator.NewReader(fileName)
+	return &Client{
+		ctx:     ctx,
+		cancel:  cancel,
+		host:    host,
+		opts:    opts,
+		tcpConn: tcpConn,
+	}, nil
+}
 
-	fileMeta, err := json.Marshal(&fileReader.FileMeta)
+// Put uploads the files of the manifest and blocks until the server confirmed them or the transfer failed
+func (c *Client) Put(manifest *fileoperator.Manifest) error {
+	sources, err := c.sources()
 	if err != nil {
-		log.Fatal("Fail to parse file meta data, error:", err)
+		return err
 	}
-	log.Println("Send file info", string(fileMeta))
-	if _, err := tcpConn.Write(append(fileMeta, '\n')); err != nil {
-		log.Fatal("Fail to send file meta data, error:", err)
+
+	request := &model.Request{
+		Op:          consts.OpPut,
+		OnConflict:  string(c.opts.OnConflict),
+		Compression: c.opts.Compression,
+		Sockets:     c.opts.Sockets,
+		Sources:     addresses(sources), // the server only takes chunks from them and the address of the control connection
+		Resumable:   c.opts.Resume > 0,
+	}
+	if err := c.sendRequest(request); err != nil {
+		return err
 	}
 
-	// 4. ACK and ready to start
-	ACK, _ := bufio.NewReader(tcpConn).ReadString('\n')
-	log.Println(ACK)
+	if err := c.resumable(request); err != nil {
+		return err
+	}
 
-	return &Client{
-		ctx:        ctx,
-		tcpConn:    tcpconn.New(tcpConn),
-		cancel:     cancel,
-		fileReader: fileReader,
-		udpClient:  udpClient,
+	// 1. learn the UDP ports of the server and create UDP clients
+	udpPorts, token, err := c.tcpConn.GetPorts()
+	if err != nil {
+		return err
 	}
-}
 
-func (c *Client) GetFileMeta() fileoperator.FileMeta {
-	return c.fileReader.FileMeta
-}
+	paths, err := c.dialPaths(udpPorts, sources)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, path := range paths {
+			path.Close()
+		}
+	}()
+	log.Println("UDP buffer value is:", paths[0].Clients[0].GetBufferValue())
 
-func (c *Client) Close() {
-	log.Println("Start to close client")
-	c.tcpConn.Close()
-	log.Println("TCP Connection closed")
-	c.udpClient.Close()
-	log.Println("UDP Connection closed")
-	c.fileReader.Close()
-	log.Println("File reader closed")
-	c.cancel()
-	log.Println("Context closed")
-}
+	// 2. exchange File metadata
+	manifest.Dest = c.opts.Dest
+	manifest.Compression = c.opts.Compression
+	if err := c.tcpConn.SendManifest(manifest); err != nil {
+		return fmt.Errorf("fail to send file meta data: %w", err)
+	}
 
-func (c *Client) Run() {
-	if toggle.MultiThreadEmit {
-		c.multiThreadEmit()
-	} else {
-		c.singleThreadEmit()
+	// 3. ACK and ready to start
+	ACK, err := c.tcpConn.WaitReply()
+	if err != nil {
+		return err
 	}
-}
+	log.Println(ACK)
 
-func (c *Client) multiThreadEmit() {
-	indexChan := make(chan *uint32, 1)
-	log.Println("indexChan limit", 1)
+	fileReader := fileoperator.NewReader(manifest, c.opts.Read)
+	defer fileReader.Close()
 
-	go c.readAndEmitWorker(indexChan)
-	log.Println("readAndEmitWorker started.")
-	go c.feedbackWorker(indexChan)
-	log.Println("feedbackWorker started.")
+	sender := transfer.NewSender(c.ctx, c.tcpConn, paths, token, fileReader, c.opts.Mode, c.opts.Rate)
+	defer sender.Close()
 
-	if err := c.tcpConn.RequestValidation(); err != nil {
-		log.Println("RequestValidation failed. ", err)
-	}
+	// our address changed, the UDP clients still send from the old one
+	c.tcpConn.OnMigrate(func() {
+		paths, err := c.dialPaths(udpPorts, sources)
+		if err != nil {
+			log.Println("Fail to reach the server from our new address.", err)
+			return
+		}
 
-	select {
-	case <-c.ctx.Done():
-		log.Println("full cycle done cancelled")
-	}
-}
+		sender.Migrate(paths)
+	})
 
-func (c *Client) feedbackWorker(indexChan chan *uint32) {
-	go func() {
-		for {
-			signal, err := c.tcpConn.Wait()
-			if err != nil {
-				log.Println(err)
-				if strings.Contains(err.Error(), "use of closed network connection") || err == io.EOF {
-					c.Close()
-					break
-				}
-				continue
-			}
-
-			log.Println("Server is asking", signal)
-
-			if strings.HasPrefix(signal, consts.Finished) {
-				log.Println("Finished, cancel context")
-				c.Close()
-				log.Println("Fully cancelled")
-				break
-			}
-
-			if strings.HasPrefix(signal, consts.NeedPacket) {
-				index := extractPacketIndex(signal)
-
-				log.Printf("User is requesting chunk of %d/%d", index, c.fileReader.FileMeta.TotalPacketCount-1)
-
-				for walker := index; walker < c.fileReader.FileMeta.TotalPacketCount && walker < index+consts.PacketCountPerRound; walker++ {
-					log.Println("Push index", walker, "into channel")
-					indexChan <- util.Uint32Ptr(walker)
-					//time.Sleep(time.Microsecond)
-				}
-
-				log.Println("Asking server do validation")
-				if err := c.tcpConn.RequestValidation(); err != nil {
-					log.Println("RequestValidation failed. ", err)
-				}
-			}
-		}
-	}()
+	err = sender.Run()
+	c.stats = sender.Stats()
+	return err
+}
 
-	select {
-	case <-c.ctx.Done():
-		for len(indexChan) > 0 {
-			<-indexChan
-		}
+// Get downloads the given paths of the server into the local Dest directory.
+// The roles flip: the server emits over UDP and we reassemble and ask for the missing chunks.
+func (c *Client) Get(paths []string) (*fileoperator.Manifest, error) {
+	request := &model.Request{
+		Op:          consts.OpGet,
+		Paths:       paths,
+		Rate:        c.opts.Rate,
+		Preserve:    c.opts.Preserve,
+		Compression: c.opts.Compression,
+		ChunkSize:   sessionChunkSize(c.opts),
+		Resumable:   c.opts.Resume > 0,
+	}
+	if err := c.sendRequest(request); err != nil {
+		return nil, err
+	}
 
-		indexChan <- nil
-		log.Println("feedbackWorker cancelled")
+	if err := c.resumable(request); err != nil {
+		return nil, err
 	}
-}
 
-func extractPacketIndex(msg string) uint32 {
-	packetIndexStr := strings.Trim(msg, consts.NeedPacket)
-	index, err := strconv.ParseUint(packetIndexStr, 10, 32)
+	manifest, err := c.tcpConn.GetManifest()
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
+	log.Println("Got manifest", manifest.String())
 
-	return uint32(index)
-}
-
-func (c *Client) readAndEmitWorker(indexChan chan *uint32) {
-	go func() {
-		for {
-			index := <-indexChan
-			if index == nil {
-				break
-			}
-
-			indexVal := *index
-			log.Printf("start to read chunk %d/%d\n", indexVal, c.fileReader.FileMeta.TotalPacketCount-1)
-			offset := indexVal * consts.PayloadDataSizeByte
-			log.Printf("Read index %d with offset %d.\n", indexVal, offset)
-			bytesread := c.fileReader.ReadAt(int64(offset))
-			payload := buildPayLoad(bytesread, indexVal)
-			err := c.udpClient.SendAsync(c.ctx, payload)
-			log.Printf("Chunk %d of size %d sent\n", indexVal, len(bytesread))
-			if err != nil {
-				fmt.Print(err)
-				break
-			}
-		}
-	}()
+	// like tar run by root, we trust the server we chose with the owners of the files
+	writer, err := fileoperator.NewWriter(c.opts.Dest, manifest, c.opts.OnConflict, fileoperator.Ownership{Any: true})
+	if err != nil {
+		c.tcpConn.SendError(err)
+		return nil, err
+	}
 
-	select {
-	case <-c.ctx.Done():
-		for len(indexChan) > 0 {
-			<-indexChan
-		}
+	sockets := c.opts.Sockets
+	if sockets <= 0 {
+		sockets = 1
+	}
 
-		indexChan <- nil
-		log.Println("readAndEmitWorker cancelled")
+	// only the server may send chunks, from the address we reach it at
+	guard, err := udp_server.NewGuard(c.tcpConn.RemoteHost())
+	if err != nil {
+		writer.Close()
+		c.tcpConn.SendError(fmt.Errorf("fail to start UDP server"))
+		return nil, err
 	}
-}
 
-func (c *Client) singleThreadEmit() {
-	progress := fmt.Sprintf("%s%d", consts.NeedPacket, 0)
-	for strings.HasPrefix(progress, consts.NeedPacket) {
-		strArr := strings.Split(progress, ":")
-		index, err := strconv.ParseUint(strArr[1], 10, 32)
-		if err != nil {
-			log.Printf("Fail to parse progress index value. %s. Error: %s. \n", progress, err)
-			index = 0 // if cannot find, then start by 0 index
+	servers, err := udp_server.Listen(":0", sockets, consts.MaxChunkSize, guard)
+	if err != nil {
+		writer.Close()
+		c.tcpConn.SendError(fmt.Errorf("fail to start UDP server"))
+		return nil, err
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
 		}
+	}()
 
-		if toggle.SerialRead {
-			serialReadAndEmit(c.ctx, c.fileReader.File, c.udpClient, uint32(index))
-		} else {
-			c.skipReadAndEmit(c.ctx, c.udpClient, uint32(index), c.fileReader.FileMeta.Size)
-		}
+	receiver := transfer.NewReceiver(c.ctx, c.tcpConn, servers, manifest, writer, c.opts.Workers)
+	c.tcpConn.SendPorts(udp_server.Ports(servers), guard.Token())
+	err = receiver.Run()
+	c.stats = receiver.Stats()
+	return manifest, err
+}
 
-		log.Println("Asking server do validation")
-		if err := c.tcpConn.RequestValidation(); err != nil {
-			log.Println("RequestValidation failed. ", err)
-		}
+// resumable learns the session the server opened for a resumable request, from then on the control channel dials
+// the server again when its connection breaks
+func (c *Client) resumable(request *model.Request) error {
+	if !request.Resumable {
+		return nil
+	}
 
-		progress, err = c.tcpConn.Wait()
-		if err != nil {
-			log.Println("Fail to get validation result ", err)
-			progress = fmt.Sprintf("%s%d", consts.NeedPacket, 0)
-		}
+	id, token, err := c.tcpConn.GetSession()
+	if err != nil {
+		return err
 	}
-}
 
-func serialReadAndEmit(ctx context.Context, file *os.File, client *udp_client.UDPClient, start uint32) {
-	index := start
-	bufferSize := consts.PayloadDataSizeByte
-	buffer := make([]byte, bufferSize)
-	for {
-		bytesread, err := file.Read(buffer)
-		log.Println("Bytes read: ", bytesread)
-		if err != nil {
-			log.Println("Finished reading")
-			log.Println(err)
-			return
-		}
+	if id == "" {
+		log.Println("The server does not resume transfers")
+		return nil
+	}
 
-		encoded := base64.StdEncoding.EncodeToString(buffer[:bytesread])
-		payload := fmt.Sprintf("%d,%s", index, encoded)
-		err = client.SendAsync(ctx, []byte(payload))
-		fmt.Printf("Chunk %d sent\n", index)
-		if err != nil {
-			fmt.Print(err)
-		}
+	// the server wants our credentials again to resume
+	resume := &model.Request{Op: consts.OpResume, Session: id, Token: token}
+	c.authenticate(resume)
+	c.tcpConn.Redial(c.opts.Resume, func() (net.Conn, error) {
+		return net.DialTimeout("tcp", c.opts.Server, redialTimeout)
+	}, resume)
+	return nil
+}
 
-		index++
-	}
+// Stats tells how many chunks the last transfer sent or received and how well they were compressed
+func (c *Client) Stats() transfer.Stats {
+	return c.stats
 }
 
-func (c *Client) skipReadAndEmit(ctx context.Context, udpClient *udp_client.UDPClient, index uint32, filesize int64) {
-	for ; int64(index) < filesize; index++ {
-		bytesread := c.fileReader.ReadAt(int64(index) * consts.PayloadDataSizeByte)
-		payload := buildPayLoad(bytesread, index)
-		err := udpClient.SendAsync(ctx, payload)
-		log.Printf("Chunk %d of size %d sent\n", index, bytesread)
+// sessionChunkSize picks the chunk data size of a session so no datagram gets fragmented on the way to the server
+func sessionChunkSize(opts Options) int {
+	host, _, _ := net.SplitHostPort(opts.Server)
+	mtu, ipv6 := opts.MTU, strings.Contains(host, ":")
+	if mtu == 0 {
+		probed, probedIPv6, err := pmtu.Probe(opts.Server)
 		if err != nil {
-			fmt.Print(err)
+			log.Printf("Fail to probe the path MTU, assume %d. Error: %s\n", pmtu.DefaultMTU, err)
+			probed = pmtu.DefaultMTU
+		} else {
+			ipv6 = probedIPv6
 		}
+		mtu = probed
 	}
-}
 
-func getUcpDstPort(tcpConn net.Conn) (string, error) {
-	udpPort, err := bufio.NewReader(tcpConn).ReadString('\n')
-	if err != nil {
-		return "", err
-	}
+	chunkSize := pmtu.ChunkSize(mtu, ipv6)
+	log.Printf("Path MTU %d, chunk size %d\n", mtu, chunkSize)
+	return chunkSize
+}
 
-	if len(udpPort) == 0 {
-		return "", fmt.Errorf("Invalid udp port value. Size == 0.")
+// Manage sends a file management request and decodes the server's answer into result
+func (c *Client) Manage(request *model.Request, result interface{}) error {
+	if err := c.sendRequest(request); err != nil {
+		return err
 	}
 
-	log.Printf("Got UDP port %s", udpPort)
-	return udpPort[:len(udpPort)-1], nil
+	return c.tcpConn.GetResult(result)
 }
 
-func buildPayLoad(chunk []byte, index uint32) []byte {
-	encoded := base64.StdEncoding.EncodeToString(chunk)
-	payload := fmt.Sprintf("%d,%s", index, encoded)
-	return []byte(payload)
+func (c *Client) Close() {
+	log.Println("Start to close client")
+	c.tcpConn.Close()
+	log.Println("TCP Connection closed")
+	c.cancel()
+	log.Println("Context closed")
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/pmtu"
+	"os"
+	"time"
+)
+
+func getCommand(args []string) int {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: safe-udp get <remote path...> [flags]")
+		fs.PrintDefaults()
+	}
+
+	opts := Options{}
+	fs.StringVar(&opts.Server, "server", "localhost:8888", "server control address as host:port")
+	authFlags(fs, &opts)
+	fs.StringVar(&opts.Dest, "dest", ".", "local directory to store the files in")
+	onConflict := fs.String("on-conflict", string(fileoperator.ConflictFail), "what to do with files that already exist locally: fail, overwrite, rename or version")
+	fs.Float64Var(&opts.Rate, "rate", 0, "rate limit in Mbit/s the server should emit at, 0 means unlimited")
+	fs.BoolVar(&opts.Preserve, "preserve", false, "keep mode, times, ownership (when running as root) and extended attributes")
+	compress := fs.Bool("compress", false, "ask the server to compress the chunks with DEFLATE")
+	fs.IntVar(&opts.MTU, "mtu", 0, "path MTU from the server, 0 probes it")
+	fs.IntVar(&opts.Sockets, "sockets", 1, "UDP sockets to stripe the chunks over")
+	fs.IntVar(&opts.Workers, "decode-workers", consts.RawDataWorkerNumber, "go routines decoding the chunks, 0 runs one per CPU")
+	fs.DurationVar(&opts.Resume, "resume", 30*time.Second, "how long to try to reconnect when the control connection breaks, e.g. after the address changed, 0 never")
+
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp get: no remote path given")
+		fs.Usage()
+		return exitUsage
+	}
+
+	if opts.OnConflict, err = fileoperator.ParseConflictPolicy(*onConflict); err != nil {
+		fmt.Fprintf(os.Stderr, "safe-udp %s: %s\n", fs.Name(), err)
+		return exitUsage
+	}
+
+	if *compress {
+		opts.Compression = consts.CompressionDeflate
+	}
+
+	if opts.MTU != 0 && opts.MTU < pmtu.MinMTU {
+		fmt.Fprintf(os.Stderr, "safe-udp get: mtu must be at least %d\n", pmtu.MinMTU)
+		return exitUsage
+	}
+
+	if opts.Sockets <= 0 || opts.Sockets > consts.MaxSessionSockets {
+		fmt.Fprintf(os.Stderr, "safe-udp get: sockets must be in [1, %d]\n", consts.MaxSessionSockets)
+		return exitUsage
+	}
+
+	if opts.Workers < 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp get: decode-workers must not be negative")
+		return exitUsage
+	}
+
+	if opts.Resume < 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp get: resume must not be negative")
+		return exitUsage
+	}
+
+	if opts.Rate < 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp get: rate must not be negative")
+		return exitUsage
+	}
+
+	return exitCode("get", getFiles(paths, opts))
+}
+
+func getFiles(paths []string, opts Options) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	c, err := NewClient(ctx, cancel, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	manifest, err := c.Get(paths)
+	if err != nil {
+		return err
+	}
+
+	printStats("Files received", manifest, c.Stats(), time.Since(start))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/transfer"
+	"log"
+	"os"
+)
+
+// Exit codes of the safe-udp command. Scripts can rely on these values.
+const (
+	exitOK       = 0 // every transfer finished and was verified by the receiver
+	exitFailure  = 1 // the transfer could not be completed
+	exitUsage    = 2 // bad command line
+	exitMismatch = 3 // all packets arrived but the checksum of a file did not match
+)
+
+const usageText = `Usage: safe-udp <command> [arguments]
+
+Commands:
+  send <file...>   upload files and directories to the server
+  get <path...>    download files and directories from the server
+  ls [path]        list a directory on the server
+  stat <path...>   show size, mode, modification time and SHA-256 of files on the server
+  rm <path...>     remove files or directories on the server
+  mkdir <path...>  create directories on the server
+
+Run "safe-udp <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usageText)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "send":
+		return sendCommand(args[1:])
+	case "get":
+		return getCommand(args[1:])
+	case consts.OpList, consts.OpStat, consts.OpRemove, consts.OpMkdir:
+		return remoteCommand(args[0], args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usageText)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "safe-udp: unknown command %q\n\n%s", args[0], usageText)
+		return exitUsage
+	}
+}
+
+// exitCode reports the outcome of a command and maps it to the exit code
+func exitCode(command string, err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, transfer.ErrMismatch):
+		fmt.Fprintf(os.Stderr, "safe-udp %s: %s\n", command, err)
+		return exitMismatch
+	default:
+		fmt.Fprintf(os.Stderr, "safe-udp %s: %s\n", command, err)
+		return exitFailure
+	}
+}
+
+// parseArgs parses flags that may appear before, between or after the positional arguments,
+// so both "send a.txt --server x:1" and "send --server x:1 a.txt" work.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
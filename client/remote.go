@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"os"
+)
+
+// remoteCommand runs the file management commands: ls, stat, rm and mkdir
+func remoteCommand(op string, args []string) int {
+	fs := flag.NewFlagSet(op, flag.ContinueOnError)
+	fs.Usage = func() {
+		if op == consts.OpList {
+			fmt.Fprintln(fs.Output(), "Usage: safe-udp ls [remote path] [flags]")
+		} else {
+			fmt.Fprintf(fs.Output(), "Usage: safe-udp %s <remote path...> [flags]\n", op)
+		}
+		fs.PrintDefaults()
+	}
+
+	opts := Options{}
+	request := &model.Request{Op: op}
+	fs.StringVar(&opts.Server, "server", "localhost:8888", "server control address as host:port")
+	authFlags(fs, &opts)
+	if op == consts.OpRemove {
+		fs.BoolVar(&request.Recursive, "r", false, "remove directories and their content")
+	}
+
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if op == consts.OpList && len(paths) > 1 || op != consts.OpList && len(paths) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	request.Paths = paths
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c, err := NewClient(ctx, cancel, opts)
+	if err != nil {
+		return exitCode(op, err)
+	}
+	defer c.Close()
+
+	switch op {
+	case consts.OpList:
+		var listings [][]model.FileStat
+		if err := c.Manage(request, &listings); err != nil {
+			return exitCode(op, err)
+		}
+
+		for _, listing := range listings {
+			for _, stat := range listing {
+				fmt.Println(stat.String())
+			}
+		}
+	case consts.OpStat:
+		var stats []model.FileStat
+		if err := c.Manage(request, &stats); err != nil {
+			return exitCode(op, err)
+		}
+
+		for _, stat := range stats {
+			fmt.Printf("  File: %s\n  Size: %d\n  Mode: %s\nModify: %s\n", stat.Name, stat.Size, os.FileMode(stat.Mode), stat.ModTime)
+			if stat.Checksum != "" {
+				fmt.Printf("SHA256: %s\n", stat.Checksum)
+			}
+		}
+	default:
+		var names []string
+		if err := c.Manage(request, &names); err != nil {
+			return exitCode(op, err)
+		}
+	}
+
+	return exitOK
+}
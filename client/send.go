@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/pmtu"
+	"github.com/gtxistxgao/safe-udp/common/toggle"
+	"github.com/gtxistxgao/safe-udp/common/transfer"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func sendCommand(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: safe-udp send <file or directory...> [flags]")
+		fs.PrintDefaults()
+	}
+
+	opts := Options{}
+	fs.StringVar(&opts.Server, "server", "localhost:8888", "server control address as host:port")
+	authFlags(fs, &opts)
+	fs.StringVar(&opts.Dest, "dest", "", "directory on the server to store the files in")
+	onConflict := fs.String("on-conflict", string(fileoperator.ConflictFail), "what to do with files that already exist on the server: fail, overwrite, rename or version")
+	fs.Float64Var(&opts.Rate, "rate", 0, "emit rate limit in Mbit/s, 0 means unlimited")
+	fs.StringVar(&opts.Mode, "mode", defaultMode(), "emit mode: multi or single")
+	fs.BoolVar(&opts.Preserve, "preserve", false, "keep mode, times, ownership (when the server runs as root) and extended attributes")
+	compress := fs.Bool("compress", false, "compress the chunks with DEFLATE, chunks that do not get smaller are sent raw")
+	fs.IntVar(&opts.MTU, "mtu", 0, "path MTU towards the server, 0 probes it")
+	fs.IntVar(&opts.Sockets, "sockets", 1, "UDP sockets to stripe the chunks over")
+	bind := fs.String("bind", "", "comma separated local addresses or interfaces to send from, one path each")
+	readAhead := fs.Int("read-ahead", fileoperator.DefaultReadOptions.Window>>10, "KiB read from a file at once, the windows read last are kept for resends")
+	fs.BoolVar(&opts.Read.Mmap, "mmap", false, "map the files instead of reading them, they must not shrink while they are sent")
+	fs.DurationVar(&opts.Resume, "resume", 30*time.Second, "how long to try to reconnect when the control connection breaks, e.g. after the address changed, 0 never")
+
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp send: no file or directory given")
+		fs.Usage()
+		return exitUsage
+	}
+
+	if opts.Mode != transfer.ModeMulti && opts.Mode != transfer.ModeSingle {
+		fmt.Fprintf(os.Stderr, "safe-udp send: unknown mode %q\n", opts.Mode)
+		return exitUsage
+	}
+
+	if opts.OnConflict, err = fileoperator.ParseConflictPolicy(*onConflict); err != nil {
+		fmt.Fprintf(os.Stderr, "safe-udp %s: %s\n", fs.Name(), err)
+		return exitUsage
+	}
+
+	if *compress {
+		opts.Compression = consts.CompressionDeflate
+	}
+
+	if opts.MTU != 0 && opts.MTU < pmtu.MinMTU {
+		fmt.Fprintf(os.Stderr, "safe-udp send: mtu must be at least %d\n", pmtu.MinMTU)
+		return exitUsage
+	}
+
+	if opts.Sockets <= 0 || opts.Sockets > consts.MaxSessionSockets {
+		fmt.Fprintf(os.Stderr, "safe-udp send: sockets must be in [1, %d]\n", consts.MaxSessionSockets)
+		return exitUsage
+	}
+
+	if *bind != "" {
+		opts.Bind = strings.Split(*bind, ",")
+		if len(opts.Bind) > consts.MaxSessionPaths {
+			fmt.Fprintf(os.Stderr, "safe-udp send: at most %d bind addresses\n", consts.MaxSessionPaths)
+			return exitUsage
+		}
+	}
+
+	if opts.Resume < 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp send: resume must not be negative")
+		return exitUsage
+	}
+
+	if opts.Rate < 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp send: rate must not be negative")
+		return exitUsage
+	}
+
+	if *readAhead <= 0 {
+		fmt.Fprintln(os.Stderr, "safe-udp send: read-ahead must be positive")
+		return exitUsage
+	}
+	opts.Read.Window = *readAhead << 10
+
+	paths, err := expandPaths(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "safe-udp send:", err)
+		return exitFailure
+	}
+
+	manifest, err := fileoperator.NewManifest(paths, sessionChunkSize(opts))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "safe-udp send:", err)
+		return exitFailure
+	}
+
+	if opts.Preserve {
+		if err := manifest.CollectMetadata(); err != nil {
+			fmt.Fprintln(os.Stderr, "safe-udp send:", err)
+			return exitFailure
+		}
+	}
+
+	return exitCode("send", sendFiles(manifest, opts))
+}
+
+// expandPaths resolves glob patterns the shell did not expand and checks every path exists
+func expandPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if _, err := os.Lstat(arg); err == nil {
+			paths = append(paths, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", arg, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file or directory", arg)
+		}
+
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
+
+func defaultMode() string {
+	if toggle.MultiThreadEmit {
+		return transfer.ModeMulti
+	}
+
+	return transfer.ModeSingle
+}
+
+func sendFiles(manifest *fileoperator.Manifest, opts Options) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	c, err := NewClient(ctx, cancel, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Put(manifest); err != nil {
+		return err
+	}
+
+	printStats("Files sent", manifest, c.Stats(), time.Since(start))
+	return nil
+}
+
+func printStats(what string, manifest *fileoperator.Manifest, stats transfer.Stats, elapsed time.Duration) {
+	log.Println(what, "cost", elapsed)
+	log.Println("Manifest", manifest.String())
+	if holes := manifest.HoleSize(); holes > 0 {
+		log.Printf("Skipped %d bytes of holes\n", holes)
+	}
+	log.Println("Chunks", stats.String())
+	log.Printf("Speed: %f Kb/s\n", float64(manifest.Size)/1024/elapsed.Seconds())
+	log.Printf("Speed: %f Mb/s\n", float64(manifest.Size)/1024/1024/elapsed.Seconds())
+}
@@ -0,0 +1,43 @@
+package bufpool
+
+// Pool keeps byte buffers of one size for reuse, so the packet pipeline stops allocating once it is warm.
+// Buffers go from the UDP layer to the codec, the reassembly heap and the writer, whoever is done with one
+// hands it back with Put.
+type Pool struct {
+	size int
+	free chan []byte
+}
+
+// New makes a pool of size byte buffers keeping at most keep of them when they are handed back
+func New(size int, keep int) *Pool {
+	return &Pool{
+		size: size,
+		free: make(chan []byte, keep),
+	}
+}
+
+// Get returns a buffer of Size bytes, a free one if there is
+func (p *Pool) Get() []byte {
+	select {
+	case buffer := <-p.free:
+		return buffer
+	default:
+		return make([]byte, p.size)
+	}
+}
+
+// Put hands back a buffer from Get, any slice of it. A full pool lets the buffer go to the garbage collector.
+func (p *Pool) Put(buffer []byte) {
+	if cap(buffer) < p.size {
+		return
+	}
+
+	select {
+	case p.free <- buffer[:p.size]:
+	default:
+	}
+}
+
+func (p *Pool) Size() int {
+	return p.size
+}
@@ -0,0 +1,24 @@
+package bufpool
+
+import "testing"
+
+// a warm pool hands out and takes back buffers without allocating
+func BenchmarkGetPut(b *testing.B) {
+	pool := New(8192, 64)
+	pool.Put(pool.Get())
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pool.Put(pool.Get())
+	}
+}
+
+// a full pool drops what is handed back, so the next Get allocates
+func BenchmarkGetPutFull(b *testing.B) {
+	pool := New(8192, 0)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pool.Put(pool.Get())
+	}
+}
@@ -1,8 +1,19 @@
 package consts
 
 const MaxMemoryBufferMB = 100
-const PayloadDataSizeByte = 1500
-const MaxChunkSize = 3000
+const PayloadDataSizeByte = 1500 // chunk data size when the path MTU is not probed
+const MinPayloadDataSizeByte = 256
+const MaxPayloadDataSizeByte = 6000
+const MaxChunkSize = 8192 // a framed chunk of the max data size fits
 const MaxUserLimit = 1
-const RawDataWorkerNumber = 1
+const RawDataWorkerNumber = 0 // decode workers of a receiver, 0 runs one per CPU
 const PacketCountPerRound = 1000000
+
+// Chunk compression codecs, the sender announces the one it uses in the manifest
+const CompressionNone = ""
+const CompressionDeflate = "deflate"
+
+const UDPBatchSize = 64 // datagrams per sendmmsg or recvmmsg
+const MaxSessionSockets = 64
+const MaxSessionPaths = 16
+const MaxRequestSize = 1 << 20 // bytes of the request a client sends before it is authenticated
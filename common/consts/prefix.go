@@ -2,7 +2,21 @@ package consts
 
 const NeedPacket = "NeedPacket:"
 const Finished = "Finished"
+const Mismatch = "Mismatch:"
+const Error = "Error:"
+const Session = "Session:" // followed by the id and the token of a resumable session
+const Resumed = "Resumed"
+const Challenge = "Challenge:" // followed by the cookie and the proof of work bits a client answers with
 
 
 
 const Validate = "validate"
+
+// Operations a client can request from the server
+const OpPut = "put"
+const OpGet = "get"
+const OpList = "ls"
+const OpStat = "stat"
+const OpRemove = "rm"
+const OpMkdir = "mkdir"
+const OpResume = "resume" // carries on a session on a new control connection
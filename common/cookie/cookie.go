@@ -0,0 +1,147 @@
+package cookie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxBits is the hardest proof of work a server may ask for, about 2^MaxBits hashes for the client
+const MaxBits = 28
+
+// Issuer hands out the challenges a client answers before the server spends anything on it. A cookie is bound to
+// the address of the client, to the time it was issued and to a random nonce by a MAC, so the server keeps no
+// state for the challenges it issued. It only remembers the cookies answered lately, a proof is good for one
+// connection.
+type Issuer struct {
+	secret []byte
+	bits   int           // leading zero bits the proof of work must have, 0 only checks the cookie
+	maxAge time.Duration // how long a cookie stays valid
+	mu     sync.Mutex
+	used   map[string]time.Time // cookies answered already, by when they were issued, until they expire
+	swept  time.Time            // when expired cookies were last dropped from used
+}
+
+// NewIssuer makes an issuer with a fresh secret, cookies of another issuer or of an earlier run are refused
+func NewIssuer(bits int, maxAge time.Duration) (*Issuer, error) {
+	if bits < 0 || bits > MaxBits {
+		return nil, fmt.Errorf("proof of work bits must be in [0, %d]", MaxBits)
+	}
+
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return &Issuer{secret: secret, bits: bits, maxAge: maxAge, used: make(map[string]time.Time), swept: time.Now()}, nil
+}
+
+// Issue makes the challenge of a client at host: "<cookie>,<bits>", the cookie reading "<unix time>.<nonce>.<mac>"
+func (i *Issuer) Issue(host string) string {
+	buffer := make([]byte, 8)
+	rand.Read(buffer)
+	issued := strconv.FormatInt(time.Now().Unix(), 10) + "." + hex.EncodeToString(buffer)
+	return issued + "." + i.mac(host, issued) + "," + strconv.Itoa(i.bits)
+}
+
+// Verify checks the proof a client at host answered a challenge with: a cookie we issued to that host lately
+// and nobody answered before, and a solution to its proof of work
+func (i *Issuer) Verify(host string, proof string) error {
+	cookie, solution, ok := strings.Cut(proof, ",")
+	if !ok {
+		return errors.New("no proof of work")
+	}
+
+	dot := strings.LastIndexByte(cookie, '.')
+	if dot < 0 || !hmac.Equal([]byte(cookie[dot+1:]), []byte(i.mac(host, cookie[:dot]))) {
+		return errors.New("invalid cookie")
+	}
+
+	unix, _, _ := strings.Cut(cookie[:dot], ".")
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return errors.New("invalid cookie")
+	}
+
+	issued := time.Unix(seconds, 0)
+	if age := time.Since(issued); age > i.maxAge || age < -time.Minute {
+		return errors.New("expired cookie")
+	}
+
+	if zeros(cookie, solution) < i.bits {
+		return errors.New("wrong proof of work")
+	}
+
+	return i.use(cookie, issued)
+}
+
+// use remembers a cookie was answered, until it expires, and refuses it when it was already
+func (i *Issuer) use(cookie string, issued time.Time) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if now := time.Now(); now.Sub(i.swept) > i.maxAge {
+		for used, at := range i.used {
+			if now.Sub(at) > i.maxAge {
+				delete(i.used, used)
+			}
+		}
+		i.swept = now
+	}
+
+	if _, ok := i.used[cookie]; ok {
+		return errors.New("cookie answered already")
+	}
+
+	i.used[cookie] = issued
+	return nil
+}
+
+func (i *Issuer) mac(host string, issued string) string {
+	h := hmac.New(sha256.New, i.secret)
+	h.Write([]byte(host + "|" + issued))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Solve answers a challenge made by Issue: the cookie and a counter whose hash with the cookie starts with
+// enough zero bits
+func Solve(challenge string) (string, error) {
+	cookie, bitsText, ok := strings.Cut(challenge, ",")
+	if !ok {
+		return "", fmt.Errorf("invalid challenge %q", challenge)
+	}
+
+	want, err := strconv.Atoi(bitsText)
+	if err != nil || want < 0 || want > MaxBits {
+		return "", fmt.Errorf("invalid challenge %q", challenge)
+	}
+
+	for counter := uint64(0); ; counter++ {
+		solution := strconv.FormatUint(counter, 10)
+		if zeros(cookie, solution) >= want {
+			return cookie + "," + solution, nil
+		}
+	}
+}
+
+// zeros counts the leading zero bits of the hash of the cookie with a solution
+func zeros(cookie string, solution string) int {
+	sum := sha256.Sum256([]byte(cookie + "," + solution))
+	count := 0
+	for _, b := range sum {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+
+	return count
+}
@@ -0,0 +1,137 @@
+package cookie
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unsolved finds a solution of the cookie that misses the proof of work
+func unsolved(cookie string, bits int) string {
+	for counter := 0; ; counter++ {
+		solution := strconv.Itoa(counter)
+		if zeros(cookie, solution) < bits {
+			return solution
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer, err := NewIssuer(8, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewIssuer(8, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := Solve(issuer.Issue("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, solution, _ := strings.Cut(proof, ",")
+	dot := strings.LastIndexByte(cookie, '.')
+	signed, mac := cookie[:dot], cookie[dot+1:]
+	_, nonce, _ := strings.Cut(signed, ".")
+
+	// cookies issued at another time, with a MAC that holds
+	at := func(t time.Time) string {
+		issued := strconv.FormatInt(t.Unix(), 10) + "." + nonce
+		cookie := issued + "." + issuer.mac("192.0.2.1", issued)
+		solved, _ := Solve(cookie + ",8")
+		return solved
+	}
+
+	tests := []struct {
+		name  string
+		host  string
+		proof string
+		want  string // the error, empty when the proof holds
+	}{
+		{"solved", "192.0.2.1", proof, ""},
+		{"replayed", "192.0.2.1", proof, "cookie answered already"},
+		{"another host", "192.0.2.2", proof, "invalid cookie"},
+		{"no solution", "192.0.2.1", cookie, "no proof of work"},
+		{"empty", "192.0.2.1", "", "no proof of work"},
+		{"wrong solution", "192.0.2.1", cookie + "," + unsolved(cookie, 8), "wrong proof of work"},
+		{"tampered mac", "192.0.2.1", signed + "." + strings.Repeat("0", len(mac)) + "," + solution, "invalid cookie"},
+		{"no mac", "192.0.2.1", signed + "," + solution, "invalid cookie"},
+		{"tampered time", "192.0.2.1", strconv.Itoa(int(time.Now().Unix())+1) + "." + nonce + "." + mac + "," + solution, "invalid cookie"},
+		{"tampered nonce", "192.0.2.1", strings.Replace(signed, nonce, strings.Repeat("0", len(nonce)), 1) + "." + mac + "," + solution, "invalid cookie"},
+		{"not a time", "192.0.2.1", "x." + issuer.mac("192.0.2.1", "x") + ",0", "invalid cookie"},
+		{"expired", "192.0.2.1", at(time.Now().Add(-2 * time.Minute)), "expired cookie"},
+		{"from the future", "192.0.2.1", at(time.Now().Add(2 * time.Minute)), "expired cookie"},
+		{"lately", "192.0.2.1", at(time.Now().Add(-30 * time.Second)), ""},
+	}
+	for _, test := range tests {
+		err := issuer.Verify(test.host, test.proof)
+		if test.want == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.want != "" && (err == nil || err.Error() != test.want) {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.want)
+		}
+	}
+
+	if err := other.Verify("192.0.2.1", proof); err == nil || err.Error() != "invalid cookie" {
+		t.Errorf("another issuer: got %v, want invalid cookie", err)
+	}
+
+	// two challenges of the same second differ, answering one leaves the other good
+	first, _ := Solve(issuer.Issue("192.0.2.1"))
+	second, _ := Solve(issuer.Issue("192.0.2.1"))
+	if err := issuer.Verify("192.0.2.1", first); err != nil {
+		t.Error(err)
+	}
+	if err := issuer.Verify("192.0.2.1", second); err != nil {
+		t.Error(err)
+	}
+}
+
+// answered cookies are forgotten once expired, they would be refused as expired anyway
+func TestUsedCookiesExpire(t *testing.T) {
+	issuer, err := NewIssuer(0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.used["old"] = time.Now().Add(-2 * time.Minute)
+	issuer.swept = time.Now().Add(-2 * time.Minute)
+	proof, _ := Solve(issuer.Issue("192.0.2.1"))
+	if err := issuer.Verify("192.0.2.1", proof); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := issuer.used["old"]; ok || len(issuer.used) != 1 {
+		t.Errorf("expired cookies are kept: %v", issuer.used)
+	}
+}
+
+func TestSolve(t *testing.T) {
+	for _, challenge := range []string{"", "1.ab", "1.ab,x", "1.ab,-1", "1.ab," + strconv.Itoa(MaxBits+1)} {
+		if _, err := Solve(challenge); err == nil {
+			t.Errorf("Solve(%q) must fail", challenge)
+		}
+	}
+
+	proof, err := Solve("1.ab,12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, solution, _ := strings.Cut(proof, ",")
+	if cookie != "1.ab" || zeros(cookie, solution) < 12 {
+		t.Errorf("Solve gave %s, not 12 zero bits", proof)
+	}
+}
+
+func TestNewIssuerBits(t *testing.T) {
+	for _, bits := range []int{-1, MaxBits + 1} {
+		if _, err := NewIssuer(bits, time.Minute); err == nil {
+			t.Errorf("NewIssuer(%d) must fail", bits)
+		}
+	}
+}
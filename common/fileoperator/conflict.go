@@ -0,0 +1,127 @@
+package fileoperator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy tells the receiver what to do when a file it receives already exists
+type ConflictPolicy string
+
+const (
+	ConflictFail      ConflictPolicy = "fail"      // refuse the transfer, the existing file is untouched
+	ConflictOverwrite ConflictPolicy = "overwrite" // replace the existing file, readers keep the content they opened
+	ConflictRename    ConflictPolicy = "rename"    // store the new file as name-1.ext, name-2.ext, ...
+	ConflictVersion   ConflictPolicy = "version"   // keep the existing file as name.~1~, name.~2~, ... and store the new one
+)
+
+// maxConflictSuffix bounds the numbers we try for rename and version
+const maxConflictSuffix = 10000
+
+var ConflictPolicies = []ConflictPolicy{ConflictFail, ConflictOverwrite, ConflictRename, ConflictVersion}
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for _, p := range ConflictPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// checkConflict tells whether the file can be stored at finalPath under the policy, before any data is sent
+func checkConflict(finalPath string, name string, policy ConflictPolicy) error {
+	info, err := os.Lstat(finalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case policy == ConflictFail:
+		return fmt.Errorf("%s already exists", name)
+	case info.IsDir() && policy != ConflictRename:
+		return fmt.Errorf("%s already exists as a directory", name)
+	}
+
+	return nil
+}
+
+// commit moves a fully received temp file to its final path under the policy and returns where it landed.
+// Each step is a single link or rename so the final path never shows a partial file.
+func commit(tmpPath string, finalPath string, policy ConflictPolicy) (string, error) {
+	switch policy {
+	case ConflictOverwrite:
+		return finalPath, os.Rename(tmpPath, finalPath)
+	case ConflictVersion:
+		if err := keepVersion(finalPath); err != nil {
+			return "", err
+		}
+		return finalPath, os.Rename(tmpPath, finalPath)
+	case ConflictRename:
+		defer os.Remove(tmpPath)
+		for i := 0; i < maxConflictSuffix; i++ {
+			candidate := finalPath
+			if i > 0 {
+				candidate = suffixed(finalPath, i)
+			}
+
+			err := os.Link(tmpPath, candidate)
+			if err == nil {
+				return candidate, nil
+			}
+
+			if !os.IsExist(err) {
+				return "", err
+			}
+		}
+		return "", fmt.Errorf("no free name for %s", filepath.Base(finalPath))
+	default:
+		// link fails if the file showed up since we checked, so we never clobber it
+		defer os.Remove(tmpPath)
+		if err := os.Link(tmpPath, finalPath); err != nil {
+			if os.IsExist(err) {
+				return "", fmt.Errorf("%s already exists", filepath.Base(finalPath))
+			}
+			return "", err
+		}
+		return finalPath, nil
+	}
+}
+
+// keepVersion links the current file at finalPath to the first free name.~N~
+func keepVersion(finalPath string) error {
+	if _, err := os.Lstat(finalPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := 1; i < maxConflictSuffix; i++ {
+		err := os.Link(finalPath, fmt.Sprintf("%s.~%d~", finalPath, i))
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+
+		if !os.IsExist(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("too many versions of %s", filepath.Base(finalPath))
+}
+
+// suffixed turns dir/name.ext into dir/name-i.ext
+func suffixed(finalPath string, i int) string {
+	dir, base := filepath.Split(finalPath)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), i, ext))
+}
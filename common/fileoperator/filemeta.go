@@ -1,11 +1,30 @@
 package fileoperator
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 type FileMeta struct {
-	Name             string `json:"name"`
-	Size             int64  `json:"size"`
-	TotalPacketCount uint32  `json:"totalPacketCount"`
+	Name             string    `json:"name"` // slash separated path relative to the destination directory
+	Size             int64     `json:"size"`
+	Mode             uint32    `json:"mode"` // os.FileMode bits
+	FirstPacket      uint64    `json:"firstPacket"`
+	TotalPacketCount uint64    `json:"totalPacketCount"`
+	Checksum         string    `json:"checksum,omitempty"` // hex encoded SHA-256 of the whole file
+	Holes            []Extent  `json:"holes,omitempty"`    // ranges that are not sent and read as zero
+	Metadata         *Metadata `json:"metadata,omitempty"` // only when the client asks to preserve it
+	localPath        string    // where the file is on the sender side
+	dataBefore       []int64   // data bytes before every hole, see indexHoles
+}
+
+// LocalPath is where the file is on the sender side, empty for a manifest received from the other side
+func (f *FileMeta) LocalPath() string {
+	return f.localPath
+}
+
+func (f *FileMeta) IsDir() bool {
+	return os.FileMode(f.Mode).IsDir()
 }
 
 func (f *FileMeta) String() string {
@@ -0,0 +1,262 @@
+package fileoperator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Manifest describes every file transferred in one session.
+//
+// All files of a session share one chunk index space: the chunks of a file follow the chunks of the previous
+// file, starting at FileMeta.FirstPacket. So a session sending thousands of small files costs one handshake
+// and one packet stream, the same as a single big file.
+type Manifest struct {
+	Dest             string     `json:"dest,omitempty"`        // directory on the receiver side to store the files in
+	Compression      string     `json:"compression,omitempty"` // codec the sender compresses chunks with, empty for none
+	Files            []FileMeta `json:"files"`
+	Size             int64      `json:"size"`
+	TotalPacketCount uint64     `json:"totalPacketCount"`
+	ChunkSize        int        `json:"chunkSize"` // data bytes per chunk, picked by the sender to fit the path MTU
+}
+
+// NewManifest describes the given files and directories. Directories are walked recursively and their entries
+// are named relative to the parent of the directory, so sending "photos" recreates "photos/..." on the receiver.
+// Files are cut in chunks of chunkSize bytes.
+func NewManifest(paths []string, chunkSize int) (*Manifest, error) {
+	if chunkSize < consts.MinPayloadDataSizeByte || chunkSize > consts.MaxPayloadDataSizeByte {
+		return nil, fmt.Errorf("chunk size %d is out of [%d, %d]", chunkSize, consts.MinPayloadDataSizeByte, consts.MaxPayloadDataSizeByte)
+	}
+
+	m := &Manifest{ChunkSize: chunkSize}
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+
+		base := filepath.Dir(root)
+		err = filepath.WalkDir(root, func(localPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				log.Printf("Skip %s, it is not a regular file or directory", localPath)
+				return nil
+			}
+
+			rel, err := filepath.Rel(base, localPath)
+			if err != nil {
+				return err
+			}
+
+			name := filepath.ToSlash(rel)
+			if seen[name] {
+				return fmt.Errorf("%s is given more than once", name)
+			}
+			seen[name] = true
+
+			meta := FileMeta{
+				Name:      name,
+				Mode:      uint32(info.Mode()),
+				localPath: localPath,
+			}
+
+			if info.Mode().IsRegular() {
+				checksum, holes, err := scanFile(localPath, info.Size(), chunkSize)
+				if err != nil {
+					return err
+				}
+
+				meta.Size = info.Size()
+				meta.Checksum = checksum
+				meta.Holes = holes
+			}
+
+			m.add(meta)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) add(meta FileMeta) {
+	meta.TotalPacketCount = chunkCount(meta.Size-meta.HoleSize(), m.ChunkSize)
+	meta.indexHoles()
+	meta.FirstPacket = m.TotalPacketCount
+	m.Files = append(m.Files, meta)
+	m.Size += meta.Size
+	m.TotalPacketCount += meta.TotalPacketCount
+}
+
+// chunkCount is how many chunks carry dataSize bytes, the last one may be partial
+func chunkCount(dataSize int64, chunkSize int) uint64 {
+	count := uint64(dataSize / int64(chunkSize))
+	if dataSize%int64(chunkSize) != 0 {
+		count++
+	}
+
+	return count
+}
+
+// Locate returns the position in Files of the file holding the given chunk, or -1 if no file holds it
+func (m *Manifest) Locate(index uint64) int {
+	i := sort.Search(len(m.Files), func(i int) bool {
+		return m.Files[i].FirstPacket+m.Files[i].TotalPacketCount > index
+	})
+
+	if i == len(m.Files) || m.Files[i].FirstPacket > index {
+		return -1
+	}
+
+	return i
+}
+
+// Validate checks the manifest received from the other side is consistent before we act on it
+func (m *Manifest) Validate() error {
+	var next uint64
+	var size int64
+	if m.Dest != "" {
+		if err := ValidName(m.Dest); err != nil {
+			return err
+		}
+	}
+
+	if m.ChunkSize < consts.MinPayloadDataSizeByte || m.ChunkSize > consts.MaxPayloadDataSizeByte {
+		return fmt.Errorf("chunk size %d is out of [%d, %d]", m.ChunkSize, consts.MinPayloadDataSizeByte, consts.MaxPayloadDataSizeByte)
+	}
+
+	if m.Compression != consts.CompressionNone && m.Compression != consts.CompressionDeflate {
+		return fmt.Errorf("unknown compression %q", m.Compression)
+	}
+
+	for i := range m.Files {
+		f := &m.Files[i]
+		if err := ValidName(f.Name); err != nil {
+			return err
+		}
+
+		if f.FirstPacket != next {
+			return fmt.Errorf("file %s starts at chunk %d, expect %d", f.Name, f.FirstPacket, next)
+		}
+
+		if f.Size < 0 || f.Size > math.MaxInt64-size {
+			return fmt.Errorf("file %s has an invalid size %d", f.Name, f.Size)
+		}
+
+		if err := f.validHoles(m.ChunkSize); err != nil {
+			return err
+		}
+
+		if f.Metadata != nil {
+			if err := f.Metadata.validate(f.Name); err != nil {
+				return err
+			}
+		}
+
+		// the receiver admits the session by its size, a file must not take more chunks than its size needs
+		if f.TotalPacketCount != chunkCount(f.Size-f.HoleSize(), m.ChunkSize) {
+			return fmt.Errorf("file %s has size %d but %d chunks", f.Name, f.Size, f.TotalPacketCount)
+		}
+
+		f.indexHoles()
+		next += f.TotalPacketCount
+		size += f.Size
+	}
+
+	if next != m.TotalPacketCount || size != m.Size {
+		return fmt.Errorf("manifest totals do not match its files")
+	}
+
+	return nil
+}
+
+// ValidName checks a slash separated path from the other side stays below the directory it is relative to
+func ValidName(name string) error {
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("%s: absolute path is not allowed", name)
+	}
+
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return fmt.Errorf("%s: path escapes the destination directory", name)
+		}
+
+		if isDeviceName(element) {
+			return fmt.Errorf("%s: %s is a reserved device name", name, element)
+		}
+	}
+
+	return nil
+}
+
+// isDeviceName tells whether a path element is one of the names Windows maps to a device, whatever the extension.
+// We reject them on every platform so a tree can be recreated anywhere.
+func isDeviceName(element string) bool {
+	base := strings.ToUpper(strings.TrimRight(element, ". "))
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+
+	return len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) && base[3] >= '1' && base[3] <= '9'
+}
+
+// HoleSize is how many bytes of the session are holes, that is not sent
+func (m *Manifest) HoleSize() int64 {
+	var size int64
+	for i := range m.Files {
+		size += m.Files[i].HoleSize()
+	}
+
+	return size
+}
+
+func (m *Manifest) String() string {
+	return fmt.Sprintf("%d files. Total size %d. Total packet count %d", len(m.Files), m.Size, m.TotalPacketCount)
+}
+
+// Checksum returns the hex encoded SHA-256 of a file
+func Checksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,108 @@
+package fileoperator
+
+import (
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// validManifest is a file, a directory and a sparse file, chunks of 1000 bytes
+func validManifest() *Manifest {
+	return &Manifest{
+		Dest:      "backup",
+		ChunkSize: 1000,
+		Files: []FileMeta{
+			{Name: "a.txt", Size: 2500, Mode: 0644, FirstPacket: 0, TotalPacketCount: 3},
+			{Name: "dir", Mode: uint32(os.ModeDir | 0755), FirstPacket: 3},
+			{Name: "dir/sparse", Size: 4500, Mode: 0644, FirstPacket: 3, TotalPacketCount: 3,
+				Holes:    []Extent{{Offset: 1000, Length: 1000}, {Offset: 4000, Length: 500}},
+				Metadata: &Metadata{Uid: 1000, Gid: 1000, Xattrs: map[string][]byte{"user.tag": []byte("x")}}},
+		},
+		Size:             7000,
+		TotalPacketCount: 6,
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	tooMany := make(map[string][]byte)
+	for i := 0; i <= MaxXattrs; i++ {
+		tooMany[fmt.Sprintf("user.%d", i)] = nil
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *Manifest)
+		want   string // part of the error, empty for a valid manifest
+	}{
+		{"valid", func(m *Manifest) {}, ""},
+		{"no dest", func(m *Manifest) { m.Dest = "" }, ""},
+		{"deflate", func(m *Manifest) { m.Compression = consts.CompressionDeflate }, ""},
+		{"dest escapes", func(m *Manifest) { m.Dest = "../up" }, "escapes"},
+		{"absolute dest", func(m *Manifest) { m.Dest = "/etc" }, "absolute"},
+		{"chunk too small", func(m *Manifest) { m.ChunkSize = consts.MinPayloadDataSizeByte - 1 }, "chunk size"},
+		{"chunk too big", func(m *Manifest) { m.ChunkSize = consts.MaxPayloadDataSizeByte + 1 }, "chunk size"},
+		{"unknown compression", func(m *Manifest) { m.Compression = "zstd" }, "compression"},
+		{"empty name", func(m *Manifest) { m.Files[0].Name = "" }, "invalid file name"},
+		{"name escapes", func(m *Manifest) { m.Files[0].Name = "dir/../../a" }, "escapes"},
+		{"backslash", func(m *Manifest) { m.Files[0].Name = "..\\a" }, "invalid file name"},
+		{"device name", func(m *Manifest) { m.Files[0].Name = "dir/CON.txt" }, "device"},
+		{"chunk gap", func(m *Manifest) { m.Files[2].FirstPacket = 4 }, "starts at chunk"},
+		{"chunk overlap", func(m *Manifest) { m.Files[1].FirstPacket = 2 }, "starts at chunk"},
+		{"too few chunks", func(m *Manifest) { m.Files[0].TotalPacketCount = 2 }, "chunks"},
+		{"too many chunks", func(m *Manifest) {
+			m.Files[0].TotalPacketCount++
+			m.Files[2].FirstPacket++
+			m.TotalPacketCount++
+		}, "chunks"},
+		{"tiny size", func(m *Manifest) {
+			m.Files[0].Size = 1
+			m.Size -= 2499
+		}, "chunks"},
+		{"directory with chunks", func(m *Manifest) {
+			m.Files[1].TotalPacketCount = 1
+			m.Files[2].FirstPacket++
+			m.TotalPacketCount++
+		}, "chunks"},
+		{"negative size", func(m *Manifest) { m.Files[0].Size = -1 }, "size"},
+		{"size overflows", func(m *Manifest) {
+			m.Files[1].Size = math.MaxInt64 - 1000
+			m.Files[1].Mode = 0644
+		}, "size"},
+		{"hole overflows", func(m *Manifest) { m.Files[2].Holes[1].Length = math.MaxInt64 }, "hole"},
+		{"chunk count overflows", func(m *Manifest) {
+			m.Files[0].TotalPacketCount = 1 << 62
+			m.TotalPacketCount += 1<<62 - 3
+		}, "chunks"},
+		{"total chunks", func(m *Manifest) { m.TotalPacketCount++ }, "totals"},
+		{"total size", func(m *Manifest) { m.Size-- }, "totals"},
+		{"hole out of order", func(m *Manifest) {
+			m.Files[2].Holes[0], m.Files[2].Holes[1] = m.Files[2].Holes[1], m.Files[2].Holes[0]
+		}, "hole"},
+		{"hole off chunk", func(m *Manifest) { m.Files[2].Holes[0].Offset = 500 }, "hole"},
+		{"hole past end", func(m *Manifest) { m.Files[2].Holes[1].Length = 501 }, "hole"},
+		{"empty hole", func(m *Manifest) { m.Files[2].Holes[0].Length = 0 }, "hole"},
+		{"negative uid", func(m *Manifest) { m.Files[2].Metadata.Uid = -2 }, "owner"},
+		{"long owner", func(m *Manifest) { m.Files[2].Metadata.Owner = strings.Repeat("a", 300) }, "owner"},
+		{"trusted xattr", func(m *Manifest) { m.Files[2].Metadata.Xattrs["trusted.x"] = nil }, "not allowed"},
+		{"security xattr", func(m *Manifest) { m.Files[2].Metadata.Xattrs["security.capability"] = nil }, "not allowed"},
+		{"bare prefix", func(m *Manifest) { m.Files[2].Metadata.Xattrs["user."] = nil }, "not allowed"},
+		{"too many xattrs", func(m *Manifest) { m.Files[2].Metadata.Xattrs = tooMany }, "extended attributes"},
+		{"big xattr", func(m *Manifest) {
+			m.Files[2].Metadata.Xattrs["user.big"] = make([]byte, MaxXattrSize+1)
+		}, "bigger"},
+	}
+	for _, test := range tests {
+		m := validManifest()
+		test.change(m)
+		err := m.Validate()
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got %v, want an error about %s", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package fileoperator
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Only extended attributes of the user namespace are carried, the others hold security labels and capabilities
+// the receiver must not take from the other side. Their count and size are bounded like the kernel does.
+const (
+	XattrPrefix     = "user."
+	MaxXattrs       = 64
+	MaxXattrNameLen = 255
+	MaxXattrSize    = 64 << 10
+	maxNameLen      = 256 // of an owner or a group
+)
+
+// Ownership tells who the receiver may give its files to when it runs as root. The zero value gives them to
+// the receiving process, and the files lose setuid and setgid.
+type Ownership struct {
+	Any  bool         // any owner the sender asks for, for a receiver that trusts its sender
+	Uids map[int]bool // owners allowed otherwise
+	Gids map[int]bool
+}
+
+// AllowAccount lets files be given to the local account of that name and to its group, if there is one
+func (o *Ownership) AllowAccount(name string) {
+	account, err := user.Lookup(name)
+	if err != nil {
+		return
+	}
+
+	uid, uidErr := strconv.Atoi(account.Uid)
+	gid, gidErr := strconv.Atoi(account.Gid)
+	if uidErr != nil || gidErr != nil {
+		return
+	}
+
+	if o.Uids == nil {
+		o.Uids = make(map[int]bool)
+	}
+	if o.Gids == nil {
+		o.Gids = make(map[int]bool)
+	}
+	o.Uids[uid], o.Gids[gid] = true, true
+}
+
+func (o Ownership) allows(uid int, gid int) bool {
+	return o.Any || (o.Uids[uid] && o.Gids[gid])
+}
+
+// Metadata is what we keep of a file besides its content, when the client asks to preserve it.
+// Ownership is only applied when the receiver runs as root and allows it, by name first so it maps across machines.
+type Metadata struct {
+	ModTime    time.Time         `json:"modTime"`
+	AccessTime time.Time         `json:"accessTime,omitempty"`
+	Uid        int               `json:"uid"`
+	Gid        int               `json:"gid"`
+	Owner      string            `json:"owner,omitempty"`
+	Group      string            `json:"group,omitempty"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// CollectMetadata reads the metadata of every file of the manifest so the receiver can apply it
+func (m *Manifest) CollectMetadata() error {
+	for i := range m.Files {
+		metadata, err := readMetadata(m.Files[i].localPath)
+		if err != nil {
+			return err
+		}
+
+		m.Files[i].Metadata = metadata
+	}
+
+	return nil
+}
+
+func readMetadata(localPath string) (*Metadata, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &Metadata{
+		ModTime:    info.ModTime(),
+		AccessTime: accessTime(info),
+		Uid:        -1,
+		Gid:        -1,
+	}
+
+	if uid, gid, ok := ownership(info); ok {
+		metadata.Uid, metadata.Gid = uid, gid
+		if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			metadata.Owner = u.Username
+		}
+		if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+			metadata.Group = g.Name
+		}
+	}
+
+	metadata.Xattrs, err = readXattrs(localPath)
+	if err != nil {
+		log.Printf("Fail to read extended attributes of %s. Error: %s\n", localPath, err)
+	}
+
+	return metadata, nil
+}
+
+// applyMetadata sets the mode, ownership, extended attributes and times of a received file.
+// Failures are logged, the content is verified already and is worth more than its metadata.
+func applyMetadata(localPath string, mode os.FileMode, metadata *Metadata, ownership Ownership) {
+	kept := false
+	if os.Geteuid() == 0 {
+		uid, gid := metadata.Uid, metadata.Gid
+		if u, err := user.Lookup(metadata.Owner); metadata.Owner != "" && err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if g, err := user.LookupGroup(metadata.Group); metadata.Group != "" && err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+
+		if !ownership.allows(uid, gid) {
+			log.Printf("Keep the owner of %s, %d:%d is not allowed\n", localPath, uid, gid)
+		} else if err := os.Lchown(localPath, uid, gid); err != nil {
+			log.Printf("Fail to set owner of %s. Error: %s\n", localPath, err)
+		} else {
+			kept = true
+		}
+	}
+
+	// after chown, which clears setuid and setgid. They only come back on a file whose owner was kept, or
+	// anybody could plant a program running as the receiver.
+	keep := os.ModePerm | os.ModeSticky
+	if kept {
+		keep |= os.ModeSetuid | os.ModeSetgid
+	}
+	if err := os.Chmod(localPath, mode&keep); err != nil {
+		log.Printf("Fail to set mode of %s. Error: %s\n", localPath, err)
+	}
+
+	for name, value := range metadata.Xattrs {
+		if !strings.HasPrefix(name, XattrPrefix) {
+			continue
+		}
+
+		if err := writeXattr(localPath, name, value); err != nil {
+			log.Printf("Fail to set extended attribute %s of %s. Error: %s\n", name, localPath, err)
+		}
+	}
+
+	// last, everything above may touch the times
+	accessed := metadata.AccessTime
+	if accessed.IsZero() {
+		accessed = metadata.ModTime
+	}
+	if err := os.Chtimes(localPath, accessed, metadata.ModTime); err != nil {
+		log.Printf("Fail to set times of %s. Error: %s\n", localPath, err)
+	}
+}
+
+// validate checks metadata received from the other side stays within what we are willing to apply
+func (m *Metadata) validate(name string) error {
+	if m.Uid < -1 || m.Gid < -1 || len(m.Owner) > maxNameLen || len(m.Group) > maxNameLen {
+		return fmt.Errorf("file %s has an invalid owner", name)
+	}
+
+	if len(m.Xattrs) > MaxXattrs {
+		return fmt.Errorf("file %s has %d extended attributes, at most %d", name, len(m.Xattrs), MaxXattrs)
+	}
+
+	for attr, value := range m.Xattrs {
+		if !strings.HasPrefix(attr, XattrPrefix) || len(attr) == len(XattrPrefix) || len(attr) > MaxXattrNameLen ||
+			strings.ContainsRune(attr, 0) {
+			return fmt.Errorf("file %s: extended attribute %q is not allowed, only %s ones", name, attr, XattrPrefix)
+		}
+
+		if len(value) > MaxXattrSize {
+			return fmt.Errorf("file %s: extended attribute %s is bigger than %d bytes", name, attr, MaxXattrSize)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+
+package fileoperator
+
+import (
+	"os"
+	"time"
+)
+
+// only mode and modification time are kept on these systems
+
+func accessTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+func ownership(info os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+func readXattrs(localPath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattr(localPath string, name string, value []byte) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+//go:build linux || darwin
+
+package fileoperator
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"syscall"
+)
+
+func ownership(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+func readXattrs(localPath string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(localPath, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreUnsupported(err)
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(localPath, buf)
+	if err != nil {
+		return nil, ignoreUnsupported(err)
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		// the receiver only takes these, see XattrPrefix
+		if !strings.HasPrefix(name, XattrPrefix) || len(name) > MaxXattrNameLen || len(xattrs) == MaxXattrs {
+			continue
+		}
+
+		size, err := unix.Getxattr(localPath, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Getxattr(localPath, name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		if size > MaxXattrSize {
+			continue
+		}
+
+		xattrs[name] = value[:size]
+	}
+
+	return xattrs, nil
+}
+
+func writeXattr(localPath string, name string, value []byte) error {
+	return unix.Setxattr(localPath, name, value, 0)
+}
+
+// ignoreUnsupported treats a file system without extended attributes as a file without any
+func ignoreUnsupported(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package fileoperator
+
+import (
+	"errors"
+	"os"
+)
+
+// files are only mapped on Linux and macOS, elsewhere the Reader reads them
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mapping files is not supported on this system")
+}
+
+func unmapFile(mapped []byte) {
+}
+
+func adviseWillNeed(window []byte) {
+}
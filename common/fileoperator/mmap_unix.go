@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package fileoperator
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func unmapFile(mapped []byte) {
+	unix.Munmap(mapped)
+}
+
+// adviseWillNeed starts reading the pages of a window before we get to them
+func adviseWillNeed(window []byte) {
+	if len(window) > 0 {
+		unix.Madvise(window, unix.MADV_WILLNEED)
+	}
+}
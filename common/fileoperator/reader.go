@@ -1,63 +1,296 @@
 package fileoperator
 
 import (
-	"fmt"
-	"github.com/gtxistxgao/safe-udp/common/consts"
+	"container/list"
+	"io"
 	"log"
 	"os"
 )
 
+// ReadOptions tunes how a Reader gets the chunks off the disk, zero values take the defaults
+type ReadOptions struct {
+	Window      int  // bytes read at once, rounded down to whole chunks
+	CacheBlocks int  // windows kept in memory after they were read, for resends
+	Mmap        bool // map the files instead of reading them, where the system can
+}
+
+// DefaultReadOptions reads 256 KiB at once and keeps 8 MiB for resends
+var DefaultReadOptions = ReadOptions{
+	Window:      256 << 10,
+	CacheBlocks: 32,
+}
+
+// block is a window of a file in memory
+type block struct {
+	file   int   // position in Manifest.Files
+	number int64 // offset of the block in the file divided by the window
+	data   []byte
+}
+
+type blockKey struct {
+	file   int
+	number int64
+}
+
+// handle is an open file, with its mapping when the Reader maps files
+type handle struct {
+	current int // position in Manifest.Files, -1 if none is open
+	file    *os.File
+	mapped  []byte
+	advised int64 // the window of the mapping we last told the system we need, -1 for none
+}
+
+// Reader reads the chunks of the files described by a manifest.
+// It reads a window of a file at once, the window the chunks are read from in order is the read-ahead one.
+// The windows it moves past, and the ones resends ask for, stay in an LRU cache, so most resends cost no
+// read. Resends have a file handle of their own and don't move the read-ahead window.
 type Reader struct {
-	File     *os.File
+	Manifest *Manifest
 	buffer   []byte
-	FileMeta FileMeta
+	window   int
+	mmap     bool
+	ahead    *block   // the window the chunks are read from in order
+	last     blockKey // the window read from last, the next one after it is read ahead
+	started  bool     // a window was read already
+	cached   map[blockKey]*list.Element
+	lru      *list.List // of *block, most recent first
+	capacity int
+	stream   handle // the file of the read-ahead window
+	resend   handle // the file of the windows read for resends
+}
+
+func NewReader(manifest *Manifest, opts ReadOptions) *Reader {
+	if opts.Window <= 0 {
+		opts.Window = DefaultReadOptions.Window
+	}
+
+	if opts.CacheBlocks <= 0 {
+		opts.CacheBlocks = DefaultReadOptions.CacheBlocks
+	}
+
+	// chunks start at multiples of the chunk size, a window of whole chunks never splits one
+	window := opts.Window / manifest.ChunkSize * manifest.ChunkSize
+	if window == 0 {
+		window = manifest.ChunkSize
+	}
+
+	return &Reader{
+		Manifest: manifest,
+		buffer:   make([]byte, manifest.ChunkSize),
+		window:   window,
+		mmap:     opts.Mmap,
+		cached:   make(map[blockKey]*list.Element),
+		lru:      list.New(),
+		capacity: opts.CacheBlocks,
+		stream:   handle{current: -1},
+		resend:   handle{current: -1},
+	}
 }
 
-func NewReader(filePath string) *Reader {
-	log.Println("Start to open file")
-	file, err := os.Open(filePath)
+func (r *Reader) open(h *handle, i int) error {
+	if i == h.current {
+		return nil
+	}
+
+	h.close()
+	log.Println("Start to open file", r.Manifest.Files[i].localPath)
+	file, err := os.Open(r.Manifest.Files[i].localPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	h.file = file
+	h.current = i
+	h.advised = -1
+	if r.mmap && r.Manifest.Files[i].Size > 0 {
+		if h.mapped, err = mapFile(file, r.Manifest.Files[i].Size); err != nil {
+			log.Println("Fail to map", r.Manifest.Files[i].localPath, "read it instead.", err)
+		}
+	}
+
+	return nil
+}
+
+func (h *handle) close() {
+	if h.mapped != nil {
+		unmapFile(h.mapped)
+		h.mapped = nil
+	}
+
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
 	}
 
-	fileinfo, err := file.Stat()
+	h.current = -1
+}
+
+// ReadChunk reads the data of the chunk with the given session wide index into dst, which has room for a chunk,
+// and returns the part of dst holding it
+func (r *Reader) ReadChunk(index uint64, dst []byte) []byte {
+	i := r.Manifest.Locate(index)
+	if i < 0 {
+		log.Println("No file holds chunk", index)
+		return nil
+	}
+
+	offset := r.Manifest.Files[i].Offset(index-r.Manifest.Files[i].FirstPacket, r.Manifest.ChunkSize)
+	number := offset / int64(r.window)
+	if data, ok := r.readMapped(i, number, offset, dst); ok {
+		return data
+	}
+
+	b, err := r.block(i, number)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		return nil
 	}
 
-	totalPacketCount := uint32(fileinfo.Size() / consts.PayloadDataSizeByte)
-	if fileinfo.Size()%consts.PayloadDataSizeByte != 0 {
-		totalPacketCount++
+	within := int(offset - b.number*int64(r.window))
+	if within >= len(b.data) {
+		return dst[:0]
 	}
 
-	fileMetaObject := FileMeta{
-		Name:             fileinfo.Name(),
-		Size:             fileinfo.Size(),
-		TotalPacketCount: totalPacketCount,
+	return dst[:copy(dst[:r.Manifest.ChunkSize], b.data[within:])]
+}
+
+// handleFor opens file i on the handle the window with the given number is read with: reading on from the
+// window read last is the read-ahead, anything else is a resend
+func (r *Reader) handleFor(i int, number int64) (*handle, bool, error) {
+	sequential := !r.started || (r.last.file == i && (r.last.number == number || r.last.number+1 == number))
+	h := &r.resend
+	if sequential {
+		h = &r.stream
 	}
 
-	buffer := make([]byte, consts.PayloadDataSizeByte)
+	if err := r.open(h, i); err != nil {
+		return nil, false, err
+	}
 
-	return &Reader{
-		File:     file,
-		buffer:   buffer,
-		FileMeta: fileMetaObject,
+	r.started = true
+	r.last = blockKey{file: i, number: number}
+	return h, sequential, nil
+}
+
+// readMapped copies the chunk at offset of file i out of its mapping, it tells false when the file is not mapped
+func (r *Reader) readMapped(i int, number int64, offset int64, dst []byte) ([]byte, bool) {
+	if !r.mmap {
+		return nil, false
+	}
+
+	h, _, err := r.handleFor(i, number)
+	if err != nil || h.mapped == nil {
+		return nil, false
+	}
+
+	if h.advised != number {
+		h.advised = number
+		end := (number + 1) * int64(r.window)
+		if end > int64(len(h.mapped)) {
+			end = int64(len(h.mapped))
+		}
+		adviseWillNeed(h.mapped[number*int64(r.window) : end])
+	}
+
+	if offset >= int64(len(h.mapped)) {
+		return dst[:0], true
 	}
+
+	return dst[:copy(dst[:r.Manifest.ChunkSize], h.mapped[offset:])], true
 }
 
-// TODO: read the data in a fixed size and cache it in the memory. Reduce disk I/O cost
-func (r *Reader) ReadAt(offset int64) []byte {
-	n, err := r.File.ReadAt(r.buffer, offset)
-	fmt.Printf("Read offset %d, %d bytes\n", offset, n)
+// block returns the window of file i with the given number, reading it if it is not in memory
+func (r *Reader) block(i int, number int64) (*block, error) {
+	key := blockKey{file: i, number: number}
+	if b := r.ahead; b != nil && b.file == i && b.number == number {
+		r.last = key
+		return b, nil
+	}
+
+	if e, ok := r.cached[key]; ok {
+		r.lru.MoveToFront(e)
+		r.last = key
+		return e.Value.(*block), nil
+	}
+
+	h, sequential, err := r.handleFor(i, number)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+
+	b := r.spare()
+	b.file, b.number = i, number
+	if err := r.fill(h, b); err != nil {
+		return nil, err
+	}
+
+	if sequential {
+		// the window we move past stays around for resends
+		if r.ahead != nil {
+			r.keep(r.ahead)
+		}
+		r.ahead = b
+	} else {
+		r.keep(b)
+	}
+
+	return b, nil
+}
+
+// fill reads the window b stands for
+func (r *Reader) fill(h *handle, b *block) error {
+	if cap(b.data) < r.window {
+		b.data = make([]byte, r.window)
 	}
 
-	rst := make([]byte, n)
-	copy(rst, r.buffer[:n])
-	return rst
+	n, err := h.file.ReadAt(b.data[:r.window], b.number*int64(r.window))
+	b.data = b.data[:n]
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// spare returns a block to read a window into, the least recently used one once the cache is full
+func (r *Reader) spare() *block {
+	if r.lru.Len() < r.capacity {
+		return &block{}
+	}
+
+	b := r.lru.Remove(r.lru.Back()).(*block)
+	delete(r.cached, blockKey{file: b.file, number: b.number})
+	return b
+}
+
+// keep puts a window into the cache, dropping the least recently used one when it is full
+func (r *Reader) keep(b *block) {
+	if r.lru.Len() >= r.capacity {
+		r.spare()
+	}
+
+	r.cached[blockKey{file: b.file, number: b.number}] = r.lru.PushFront(b)
+}
+
+// ReadSerial reads the chunks from start to the end of the session in order and hands them to emit.
+// It stops early if emit returns false.
+func (r *Reader) ReadSerial(start uint64, emit func(index uint64, data []byte) bool) {
+	for index := start; index < r.Manifest.TotalPacketCount; index++ {
+		data := r.ReadChunk(index, r.buffer)
+		if data == nil {
+			return
+		}
+
+		if !emit(index, data) {
+			return
+		}
+	}
 }
 
 func (r *Reader) Close() {
-	r.File.Close()
+	r.stream.close()
+	r.resend.close()
+	r.ahead, r.started = nil, false
+	r.cached = make(map[blockKey]*list.Element)
+	r.lru.Init()
 }
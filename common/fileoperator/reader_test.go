@@ -0,0 +1,56 @@
+package fileoperator
+
+import (
+	"crypto/rand"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchManifest describes a file of random data, random so the scan finds no zero chunks to skip
+func benchManifest(b *testing.B, size int) *Manifest {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	name := filepath.Join(b.TempDir(), "data")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	manifest, err := NewManifest([]string{name}, consts.PayloadDataSizeByte)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return manifest
+}
+
+// benchReadAhead reads every chunk in order, as the sender does, through the read-ahead window: a chunk costs a
+// copy, windows are only allocated until the cache holds as many as it keeps
+func benchReadAhead(b *testing.B, opts ReadOptions) {
+	manifest := benchManifest(b, 8<<20)
+	reader := NewReader(manifest, opts)
+	defer reader.Close()
+	dst := make([]byte, manifest.ChunkSize)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(manifest.ChunkSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := uint64(i) % manifest.TotalPacketCount
+		if data := reader.ReadChunk(index, dst); data == nil {
+			b.Fatal("fail to read chunk", index)
+		}
+	}
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	benchReadAhead(b, DefaultReadOptions)
+}
+
+func BenchmarkReadAheadMmap(b *testing.B) {
+	opts := DefaultReadOptions
+	opts.Mmap = true
+	benchReadAhead(b, opts)
+}
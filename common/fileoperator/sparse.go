@@ -0,0 +1,158 @@
+package fileoperator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+)
+
+// Extent is a byte range of a file. Holes are aligned to chunks, only the last one may end with a partial chunk.
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// MaxHoles is how many holes a file may have, the zero chunks past them are sent as data
+const MaxHoles = 1 << 16
+
+var zeros = make([]byte, 64*1024)
+
+// scanFile computes the checksum of a file and finds its holes: the chunks the file system reports as a hole
+// and the chunks that are all zero. Holes are not sent, the receiver recreates them.
+func scanFile(localPath string, size int64, chunkSize int) (string, []Extent, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	data := dataRanges(file, size)
+	h := sha256.New()
+	buffer := make([]byte, chunkSize)
+	var holes []Extent
+	for offset := int64(0); offset < size; offset += int64(chunkSize) {
+		n := int64(chunkSize)
+		if size-offset < n {
+			n = size - offset
+		}
+
+		for len(data) > 0 && data[0].Offset+data[0].Length <= offset {
+			data = data[1:]
+		}
+
+		zero := len(data) == 0 || data[0].Offset >= offset+n
+		if zero {
+			hashZeros(h, n)
+		} else {
+			if _, err := io.ReadFull(io.NewSectionReader(file, offset, n), buffer[:n]); err != nil {
+				return "", nil, err
+			}
+			h.Write(buffer[:n])
+			zero = isZero(buffer[:n])
+		}
+
+		if !zero {
+			continue
+		}
+
+		if last := len(holes) - 1; last >= 0 && holes[last].Offset+holes[last].Length == offset {
+			holes[last].Length += n
+		} else if len(holes) < MaxHoles {
+			holes = append(holes, Extent{Offset: offset, Length: n})
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), holes, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashZeros feeds n zero bytes to h, what a hole reads as
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		size := int64(len(zeros))
+		if n < size {
+			size = n
+		}
+		h.Write(zeros[:size])
+		n -= size
+	}
+}
+
+// HoleSize is how many bytes of the file are holes, that is not sent
+func (f *FileMeta) HoleSize() int64 {
+	var size int64
+	for _, hole := range f.Holes {
+		size += hole.Length
+	}
+
+	return size
+}
+
+// indexHoles records how many data bytes come before every hole, so Offset finds the holes before a chunk by a
+// binary search instead of going through all of them for every chunk
+func (f *FileMeta) indexHoles() {
+	f.dataBefore = make([]int64, len(f.Holes))
+	var skipped int64
+	for i, hole := range f.Holes {
+		f.dataBefore[i] = hole.Offset - skipped
+		skipped += hole.Length
+	}
+}
+
+// Offset maps the n-th chunk sent for the file to its offset in the file, skipping the holes
+func (f *FileMeta) Offset(n uint64, chunkSize int) int64 {
+	offset := int64(n) * int64(chunkSize)
+	if len(f.dataBefore) != len(f.Holes) {
+		// not indexed, a file described by hand
+		for _, hole := range f.Holes {
+			if hole.Offset > offset {
+				break
+			}
+			offset += hole.Length
+		}
+		return offset
+	}
+
+	// the holes before the chunk are the ones with no more data than the chunk's offset in front of them
+	k := sort.Search(len(f.dataBefore), func(i int) bool { return f.dataBefore[i] > offset })
+	if k == 0 {
+		return offset
+	}
+
+	last := f.Holes[k-1]
+	return offset + last.Offset + last.Length - f.dataBefore[k-1]
+}
+
+// validHoles checks the holes of a file from the other side are sorted, aligned and inside the file
+func (f *FileMeta) validHoles(chunkSize int) error {
+	if len(f.Holes) > MaxHoles {
+		return fmt.Errorf("file %s has %d holes, at most %d", f.Name, len(f.Holes), MaxHoles)
+	}
+
+	var end int64
+	for _, hole := range f.Holes {
+		if hole.Offset < end || hole.Length <= 0 || hole.Offset%int64(chunkSize) != 0 || hole.Length > f.Size-hole.Offset {
+			return fmt.Errorf("file %s has an invalid hole at %d", f.Name, hole.Offset)
+		}
+
+		end = hole.Offset + hole.Length
+		if end != f.Size && hole.Length%int64(chunkSize) != 0 {
+			return fmt.Errorf("file %s has an invalid hole at %d", f.Name, hole.Offset)
+		}
+	}
+
+	return nil
+}
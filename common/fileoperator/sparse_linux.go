@@ -0,0 +1,45 @@
+package fileoperator
+
+import (
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+)
+
+// dataRanges asks the file system where the data of the file is, with SEEK_DATA and SEEK_HOLE
+func dataRanges(file *os.File, size int64) []Extent {
+	fd := int(file.Fd())
+	var ranges []Extent
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // only a hole up to the end
+		}
+
+		if err != nil {
+			// the file system does not tell, treat everything as data
+			return []Extent{{Offset: 0, Length: size}}
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return []Extent{{Offset: 0, Length: size}}
+		}
+
+		ranges = append(ranges, Extent{Offset: start, Length: end - start})
+		offset = end
+	}
+
+	return ranges
+}
+
+// punchHoles deallocates the holes of a received file, in case the file system filled them
+func punchHoles(file *os.File, holes []Extent) {
+	for _, hole := range holes {
+		err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, hole.Offset, hole.Length)
+		if err != nil {
+			log.Printf("Fail to punch hole at %d of %s. Error: %s\n", hole.Offset, file.Name(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package fileoperator
+
+import (
+	"os"
+)
+
+// dataRanges treats the whole file as data, only all zero chunks are found to be holes here
+func dataRanges(file *os.File, size int64) []Extent {
+	return []Extent{{Offset: 0, Length: size}}
+}
+
+// punchHoles relies on the holes left by seeking past them when writing
+func punchHoles(file *os.File, holes []Extent) {
+}
@@ -0,0 +1,70 @@
+package fileoperator
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// the binary search over the indexed holes finds what going through every hole finds
+func TestOffset(t *testing.T) {
+	const chunkSize = 1000
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 100; round++ {
+		f := &FileMeta{Name: "image"}
+		for chunks := random.Intn(200); chunks > 0; chunks-- {
+			if random.Intn(3) == 0 {
+				// adjacent holes are allowed, they are not always merged
+				f.Holes = append(f.Holes, Extent{Offset: f.Size, Length: chunkSize * int64(1+random.Intn(3))})
+				f.Size += f.Holes[len(f.Holes)-1].Length
+			}
+			f.Size += chunkSize
+		}
+		if random.Intn(2) == 0 {
+			f.Holes = append(f.Holes, Extent{Offset: f.Size, Length: 500}) // a trailing partial hole
+			f.Size += 500
+		}
+		if err := f.validHoles(chunkSize); err != nil {
+			t.Fatal(err)
+		}
+
+		linear := *f
+		f.indexHoles()
+		for n := uint64(0); n < chunkCount(f.Size-f.HoleSize(), chunkSize); n++ {
+			if got, want := f.Offset(n, chunkSize), linear.Offset(n, chunkSize); got != want {
+				t.Fatalf("round %d: chunk %d at %d, want %d", round, n, got, want)
+			}
+		}
+	}
+}
+
+func TestValidHolesCount(t *testing.T) {
+	f := &FileMeta{Name: "image", Size: 2 * (MaxHoles + 1) * 1000}
+	for i := int64(0); i <= MaxHoles; i++ {
+		f.Holes = append(f.Holes, Extent{Offset: 2 * i * 1000, Length: 1000})
+	}
+
+	if err := f.validHoles(1000); err == nil || !strings.Contains(err.Error(), "holes") {
+		t.Errorf("got %v, want too many holes", err)
+	}
+
+	f.Holes = f.Holes[:MaxHoles]
+	if err := f.validHoles(1000); err != nil {
+		t.Error(err)
+	}
+}
+
+// a VM image of many holes: every chunk costs a binary search, not a walk over the holes
+func BenchmarkOffset(b *testing.B) {
+	f := &FileMeta{Name: "image"}
+	for i := int64(0); i < 10000; i++ {
+		f.Holes = append(f.Holes, Extent{Offset: 2 * i * 1000, Length: 1000})
+	}
+	f.Size = 2 * 10000 * 1000
+	f.indexHoles()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f.Offset(uint64(i%10000), 1000)
+	}
+}
@@ -1,11 +1,271 @@
 package fileoperator
 
-// TODO: server use this writer
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+)
 
+// Writer recreates the files of a manifest under a destination directory.
+// Chunks must be handed to Write in index order. Every file is staged in a hidden temp file next to its final path
+// and only moved there, following the conflict policy, once it is complete and its checksum matches.
 type Writer struct {
+	manifest *Manifest
+	dest     string
+	policy   ConflictPolicy
+	owners   Ownership // who files kept with their metadata may be given to
+	next     int       // position in manifest.Files of the next entry to create
+	file     *os.File  // temp file receiving chunks, nil between files
+	meta     FileMeta  // entry of file
+	hash     hash.Hash
+	written  uint64 // chunks of file written so far
+	offset   int64  // end of the data written to file so far, holes are skipped
+	mismatch []string
+	stored   map[string]string // final path of every stored file by its name in the manifest
+	grown    int64             // bytes the stored files take, less the ones of the files they replaced
+	failed   []string          // why files could not be stored
+	dirsDone bool              // the metadata of the directories has been applied
+}
+
+func NewWriter(dest string, manifest *Manifest, policy ConflictPolicy, owners Ownership) (*Writer, error) {
+	w := &Writer{
+		manifest: manifest,
+		dest:     dest,
+		policy:   policy,
+		owners:   owners,
+		stored:   make(map[string]string),
+	}
+
+	// refuse before any data is sent if we already know a file cannot be stored
+	for _, meta := range manifest.Files {
+		localPath := w.localPath(meta)
+		if meta.IsDir() {
+			if info, err := os.Stat(localPath); err == nil && !info.IsDir() {
+				return nil, fmt.Errorf("%s already exists and is not a directory", meta.Name)
+			}
+			continue
+		}
+
+		if err := checkConflict(localPath, meta.Name, policy); err != nil {
+			return nil, err
+		}
+	}
+
+	// create the leading directories and empty files right now, they won't get any chunk
+	if err := w.advance(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) localPath(meta FileMeta) string {
+	return filepath.Join(w.dest, filepath.FromSlash(meta.Name))
+}
+
+// advance creates the entries following the current file until it reaches one that expects chunks
+func (w *Writer) advance() error {
+	for w.file == nil && w.next < len(w.manifest.Files) {
+		meta := w.manifest.Files[w.next]
+		w.next++
+
+		localPath := w.localPath(meta)
+		if meta.IsDir() {
+			if err := os.MkdirAll(localPath, os.FileMode(meta.Mode).Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+
+		file, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*.part")
+		if err != nil {
+			return err
+		}
+
+		w.file = file
+		w.meta = meta
+		w.hash = sha256.New()
+		w.written = 0
+		w.offset = 0
+		if meta.TotalPacketCount == 0 {
+			if err := w.closeFile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.Done() && !w.dirsDone {
+		w.dirsDone = true
+		w.applyDirMetadata()
+	}
+
+	return nil
+}
+
+// applyDirMetadata runs once every file is stored, creating them changed the times of their directories.
+// The deepest directories go first so setting them does not touch their parents again.
+func (w *Writer) applyDirMetadata() {
+	for i := len(w.manifest.Files) - 1; i >= 0; i-- {
+		meta := w.manifest.Files[i]
+		if meta.IsDir() && meta.Metadata != nil {
+			applyMetadata(w.localPath(meta), os.FileMode(meta.Mode), meta.Metadata, w.owners)
+		}
+	}
+}
+
+// closeFile finishes the current file: verifies it and moves it to its final path
+func (w *Writer) closeFile() error {
+	tmpPath := w.file.Name()
+	err := w.finishHoles()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	checksum := hex.EncodeToString(w.hash.Sum(nil))
+	if w.meta.Checksum != "" && w.meta.Checksum != checksum {
+		log.Printf("Checksum mismatch on %s. Expect %s, got %s\n", w.meta.Name, w.meta.Checksum, checksum)
+		w.mismatch = append(w.mismatch, w.meta.Name)
+		os.Remove(tmpPath)
+		return nil
+	}
+
+	if w.meta.Metadata != nil {
+		applyMetadata(tmpPath, os.FileMode(w.meta.Mode), w.meta.Metadata, w.owners)
+	} else if err := os.Chmod(tmpPath, os.FileMode(w.meta.Mode).Perm()); err != nil {
+		log.Println("Fail to set mode of ", w.meta.Name, err)
+	}
+
+	replaced := int64(0)
+	if w.policy == ConflictOverwrite {
+		if info, err := os.Lstat(w.localPath(w.meta)); err == nil && info.Mode().IsRegular() {
+			replaced = info.Size()
+		}
+	}
+
+	finalPath, err := commit(tmpPath, w.localPath(w.meta), w.policy)
+	if err != nil {
+		log.Printf("Fail to store %s. Error: %s\n", w.meta.Name, err)
+		os.Remove(tmpPath)
+		w.failed = append(w.failed, fmt.Sprintf("%s: %s", w.meta.Name, unwrapPath(err)))
+		return nil
+	}
+
+	w.stored[w.meta.Name] = finalPath
+	w.grown += w.meta.Size - replaced
+	if finalPath != w.localPath(w.meta) {
+		log.Printf("%s exists, stored as %s\n", w.meta.Name, filepath.Base(finalPath))
+	}
 
+	return nil
 }
 
-func NewWriter(filePath string){
+// finishHoles extends the file over a trailing hole and makes sure the holes take no space
+func (w *Writer) finishHoles() error {
+	if w.offset < w.meta.Size {
+		hashZeros(w.hash, w.meta.Size-w.offset)
+		if err := w.file.Truncate(w.meta.Size); err != nil {
+			return err
+		}
+		w.offset = w.meta.Size
+	}
 
-}
\ No newline at end of file
+	punchHoles(w.file, w.meta.Holes)
+	return nil
+}
+
+// Write saves the next chunk of the session
+func (w *Writer) Write(chunk *model.Chunk) error {
+	if w.file == nil {
+		return fmt.Errorf("no file expects chunk %d", chunk.Index)
+	}
+
+	// writing at the offset lets a failed chunk be written again, and leaves a hole in the file before it
+	offset := w.meta.Offset(w.written, w.manifest.ChunkSize)
+	if int64(len(chunk.Data)) > w.meta.Size-offset {
+		return fmt.Errorf("chunk %d goes past the end of %s", chunk.Index, w.meta.Name)
+	}
+
+	if _, err := w.file.WriteAt(chunk.Data, offset); err != nil {
+		return err
+	}
+
+	hashZeros(w.hash, offset-w.offset)
+	w.hash.Write(chunk.Data)
+	w.offset = offset + int64(len(chunk.Data))
+	w.written++
+	if w.written < w.meta.TotalPacketCount {
+		return nil
+	}
+
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	return w.advance()
+}
+
+// Done tells whether every entry of the manifest has been created
+func (w *Writer) Done() bool {
+	return w.file == nil && w.next == len(w.manifest.Files)
+}
+
+// Mismatched lists the files whose checksum does not match the manifest
+func (w *Writer) Mismatched() []string {
+	return w.mismatch
+}
+
+// Stored tells where every file stored so far landed by its name in the manifest, the conflict policy may have
+// picked another name than the one asked for
+func (w *Writer) Stored() map[string]string {
+	return w.stored
+}
+
+// Grown is how many bytes more the destination holds with the files stored so far, the files they overwrote
+// no longer count
+func (w *Writer) Grown() int64 {
+	return w.grown
+}
+
+// Failed lists why complete files could not be stored, e.g. a file of the same name showed up meanwhile
+func (w *Writer) Failed() []string {
+	return w.failed
+}
+
+// Close drops the file being received, if the transfer stops before it is complete
+func (w *Writer) Close() {
+	if w.file != nil {
+		tmpPath := w.file.Name()
+		if err := w.file.Close(); err != nil {
+			log.Println("Close file failed: ", err)
+		}
+		os.Remove(tmpPath)
+		w.file = nil
+	}
+}
+
+// unwrapPath drops the local path from a file system error
+func unwrapPath(err error) error {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err
+	}
+
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+
+	return err
+}
@@ -0,0 +1,45 @@
+package fileoperator
+
+import (
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a chunk must not write past the size the manifest was admitted with
+func TestWriteStopsAtSize(t *testing.T) {
+	manifest := &Manifest{
+		ChunkSize:        1000,
+		Files:            []FileMeta{{Name: "a", Size: 1500, Mode: 0644, TotalPacketCount: 2}},
+		Size:             1500,
+		TotalPacketCount: 2,
+	}
+	if err := manifest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	writer, err := NewWriter(dest, manifest, ConflictFail, Ownership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	if err := writer.Write(&model.Chunk{Index: 0, Data: make([]byte, 1000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Write(&model.Chunk{Index: 1, Data: make([]byte, 501)}); err == nil {
+		t.Fatal("a chunk past the end of the file is written")
+	}
+
+	if err := writer.Write(&model.Chunk{Index: 1, Data: make([]byte, 500)}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "a"))
+	if err != nil || info.Size() != 1500 || !writer.Done() {
+		t.Fatalf("got %v, %v, want a file of 1500 bytes", info, err)
+	}
+}
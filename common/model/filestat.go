@@ -0,0 +1,29 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileStat describes a file on the server, as answered to ls and stat
+type FileStat struct {
+	Name     string    `json:"name"` // slash separated path as asked by the client
+	Size     int64     `json:"size"`
+	Mode     uint32    `json:"mode"` // os.FileMode bits
+	ModTime  time.Time `json:"modTime"`
+	Checksum string    `json:"checksum,omitempty"` // hex encoded SHA-256, only answered to stat on regular files
+}
+
+func NewFileStat(name string, info os.FileInfo) FileStat {
+	return FileStat{
+		Name:    name,
+		Size:    info.Size(),
+		Mode:    uint32(info.Mode()),
+		ModTime: info.ModTime(),
+	}
+}
+
+func (f *FileStat) String() string {
+	return fmt.Sprintf("%s %12d %s %s", os.FileMode(f.Mode), f.Size, f.ModTime.Format("2006-01-02 15:04:05"), f.Name)
+}
@@ -0,0 +1,25 @@
+package model
+
+// Request is the first message of every session, the client tells the server what it wants to do
+type Request struct {
+	Op       string   `json:"op"`                 // one of the consts.Op* values
+	Proof    string   `json:"proof,omitempty"`    // answer to the challenge the server greeted the connection with
+	User     string   `json:"user,omitempty"`     // user to authenticate as with Password
+	Password string   `json:"password,omitempty"` // password of User
+	APIToken string   `json:"apiToken,omitempty"` // API token to authenticate with instead of User and Password
+	Paths    []string `json:"paths,omitempty"`    // files or directories on the server, for download
+	Rate     float64  `json:"rate,omitempty"`     // emit rate limit in Mbit/s the server should respect when sending
+
+	Recursive  bool   `json:"recursive,omitempty"`  // rm removes directories with their content
+	OnConflict string `json:"onConflict,omitempty"` // what the receiver does with existing files, a fileoperator.ConflictPolicy
+	Preserve   bool   `json:"preserve,omitempty"`   // get sends the mode, times, ownership and extended attributes of the files
+
+	Compression string   `json:"compression,omitempty"` // codec the client would like chunks compressed with, the sender decides
+	ChunkSize   int      `json:"chunkSize,omitempty"`   // chunk data size fitting the path MTU the client found, for download
+	Sockets     int      `json:"sockets,omitempty"`     // UDP sockets the client would like chunks striped over, for upload
+	Sources     []string `json:"sources,omitempty"`     // put: addresses the client sends chunks from besides the one of the control connection
+
+	Resumable bool   `json:"resumable,omitempty"` // put and get: the client would like to resume the session from a new connection
+	Session   string `json:"session,omitempty"`   // resume: the session to carry on
+	Token     string `json:"token,omitempty"`     // resume: the secret the server gave with the session id
+}
@@ -1,12 +1,13 @@
 package model
 
 type Chunk struct {
-	Index uint32 // 500 per chunk and max uint32 is 2^32. So it can support at most 1.95 TB file
+	Index uint64 // session wide, so offsets stay right for files of any size
 	Data  []byte
 }
 
-// MinHeapChunk is a min heap, the top Chunk will be the one with smallest index
-type MinHeapChunk []Chunk
+// MinHeapChunk is a min heap, the top Chunk will be the one with smallest index.
+// It holds pointers so pushing and popping through container/heap allocates nothing.
+type MinHeapChunk []*Chunk
 
 func (c *MinHeapChunk) Len() int {
 	return len(*c)
@@ -21,17 +22,18 @@ func (c *MinHeapChunk) Swap(i, j int) {
 }
 
 func (c *MinHeapChunk) Push(item interface{}) {
-	*c = append(*c, item.(Chunk))
+	*c = append(*c, item.(*Chunk))
 }
 
 func (c *MinHeapChunk) Pop() interface{} {
 	l := len(*c)
 	rst := (*c)[l-1]
+	(*c)[l-1] = nil
 	*c = (*c)[:l-1]
 	return rst
 }
 
-func (c *MinHeapChunk) Peek() Chunk {
+func (c *MinHeapChunk) Peek() *Chunk {
 	return (*c)[0]
 }
 
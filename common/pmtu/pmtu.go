@@ -0,0 +1,38 @@
+package pmtu
+
+import (
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/udp_server"
+)
+
+const (
+	DefaultMTU = 1500 // Ethernet, what we assume when the path MTU cannot be probed
+	MinMTU     = 576  // every IPv4 host must accept datagrams of this size
+	MinMTU6    = 1280
+
+	headerSize  = 20 + 8 // IPv4 and UDP headers
+	headerSize6 = 40 + 8
+	// the session token, the longest index, the commas and the compression flag of a framed chunk
+	frameOverhead = 2*udp_server.TokenSize + 20 + 4
+)
+
+// ChunkSize is the biggest chunk data size whose framed datagram fits in one IP packet of the given MTU,
+// so no datagram gets fragmented
+func ChunkSize(mtu int, ipv6 bool) int {
+	room := mtu - headerSize - frameOverhead
+	if ipv6 {
+		room = mtu - headerSize6 - frameOverhead
+	}
+
+	// base64 turns every 3 bytes into 4
+	size := room / 4 * 3
+	if size < consts.MinPayloadDataSizeByte {
+		return consts.MinPayloadDataSizeByte
+	}
+
+	if size > consts.MaxPayloadDataSizeByte {
+		return consts.MaxPayloadDataSizeByte
+	}
+
+	return size
+}
@@ -0,0 +1,98 @@
+package pmtu
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// how long we give a router to answer a too big probe with ICMP before trusting the kernel's path MTU
+const probeWait = 50 * time.Millisecond
+
+// Probe finds the path MTU towards address with a binary search over DF probes, it needs no help from the other
+// side. With IP_MTU_DISCOVER set to "do", a probe bigger than the path MTU the kernel knows fails with EMSGSIZE,
+// and a router that cannot forward one answers with ICMP "fragmentation needed", which lowers that path MTU.
+func Probe(address string) (int, bool, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+	level, discover, mtuOption, header, low := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_MTU, headerSize, MinMTU
+	if ipv6 {
+		level, discover, mtuOption, header, low = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_MTU, headerSize6, MinMTU6
+	}
+
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		return 0, ipv6, err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, discover, unix.IP_PMTUDISC_DO)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return 0, ipv6, fmt.Errorf("fail to set the DF bit: %w", err)
+	}
+
+	pathMTU := func() int {
+		mtu := 0
+		raw.Control(func(fd uintptr) {
+			mtu, _ = unix.GetsockoptInt(int(fd), level, mtuOption)
+		})
+		return mtu
+	}
+
+	// a connected socket starts with the MTU of the route, nothing bigger can go out
+	high := pathMTU()
+	if high < low {
+		return 0, ipv6, fmt.Errorf("no path MTU known towards %s", address)
+	}
+
+	fits := func(mtu int) bool {
+		probe := make([]byte, mtu-header)
+		for attempt := 0; attempt < 2; attempt++ {
+			_, err := conn.Write(probe)
+			// the other side has no UDP socket on the port, the previous probe got there anyway
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+
+			if err != nil {
+				return false
+			}
+
+			break
+		}
+
+		time.Sleep(probeWait)
+		return pathMTU() >= mtu
+	}
+
+	// nothing on the way is smaller than our own link, the common case
+	if fits(high) {
+		low = high
+	}
+
+	for low < high {
+		mid := (low + high + 1) / 2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+
+	log.Printf("Path MTU towards %s is %d\n", address, low)
+	return low, ipv6, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package pmtu
+
+import (
+	"fmt"
+)
+
+// Probe needs IP_MTU_DISCOVER, only Linux has it
+func Probe(address string) (int, bool, error) {
+	return 0, false, fmt.Errorf("path MTU probing is not supported on this system")
+}
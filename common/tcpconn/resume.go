@@ -0,0 +1,198 @@
+package tcpconn
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	redialInterval   = time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
+// resume is how a resumable control channel gets a new connection once its connection broke
+type resume struct {
+	grace     time.Duration            // how long reads and writes wait for a new connection
+	dial      func() (net.Conn, error) // reaches the server again, nil on the server side which waits for the client
+	request   *model.Request           // asks the server to resume the session on the new connection
+	hooks     []func()                 // run once a new connection replaced the broken one
+	redialing bool
+	done      chan struct{} // closed by Close, nobody waits for a new connection any more
+}
+
+// WaitForResume lets the session survive its connection breaking: reads and writes wait up to grace for the
+// client to come back on a new connection, handed over with Migrate
+func (t *TcpConn) WaitForResume(grace time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resume = &resume{grace: grace, done: make(chan struct{})}
+}
+
+// Redial lets the session survive its connection breaking: we dial the server again for up to grace and ask it to
+// resume the session with request, an OpResume one with the id and token it gave us and our credentials
+func (t *TcpConn) Redial(grace time.Duration, dial func() (net.Conn, error), request *model.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resume = &resume{
+		grace:   grace,
+		dial:    dial,
+		request: request,
+		done:    make(chan struct{}),
+	}
+}
+
+// OnMigrate registers f to run once a new connection replaced a broken one, e.g. to send the UDP data to where
+// the other side is now
+func (t *TcpConn) OnMigrate(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.resume != nil {
+		t.resume.hooks = append(t.resume.hooks, f)
+	}
+}
+
+// Migrate moves the session to the connection of next, a TcpConn made for the new connection whose reader may
+// hold messages already. The old connection is closed, reads and writes waiting on it go on with the new one.
+func (t *TcpConn) Migrate(next *TcpConn) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		next.conn.Close()
+		return
+	}
+
+	old := t.conn
+	t.conn, t.reader = next.conn, next.reader
+	close(t.migrated)
+	t.migrated = make(chan struct{})
+	var hooks []func()
+	if t.resume != nil {
+		hooks = t.resume.hooks
+	}
+	t.mu.Unlock()
+
+	old.Close()
+	log.Println("Control connection moved to", next.conn.RemoteAddr())
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// await tells whether a new connection replaced the one whose migrated channel is given, waiting for it if
+// the session can be resumed
+func (t *TcpConn) await(migrated chan struct{}) bool {
+	t.mu.Lock()
+	r := t.resume
+	if r == nil || t.closed {
+		t.mu.Unlock()
+		return false
+	}
+
+	if r.dial != nil && !r.redialing {
+		r.redialing = true
+		go t.redial(r)
+	}
+	t.mu.Unlock()
+
+	timer := time.NewTimer(r.grace)
+	defer timer.Stop()
+
+	select {
+	case <-migrated:
+		return true
+	case <-r.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// redial dials the server until it resumes the session, or the grace period is over
+func (t *TcpConn) redial(r *resume) {
+	defer func() {
+		t.mu.Lock()
+		r.redialing = false
+		t.mu.Unlock()
+	}()
+
+	for deadline := time.Now().Add(r.grace); time.Now().Before(deadline); {
+		next, err := t.handshake(r)
+		if err == nil {
+			t.Migrate(next)
+			return
+		}
+
+		log.Println("Fail to resume the session, retry.", err)
+		select {
+		case <-r.done:
+			return
+		case <-time.After(redialInterval):
+		}
+	}
+}
+
+// handshake opens a new connection and asks the server to resume the session on it
+func (t *TcpConn) handshake(r *resume) (*TcpConn, error) {
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	next := New(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := next.Answer(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := next.SendRequest(r.request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reply, err := next.Wait()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if reply != consts.Resumed {
+		// the session is over already, what the server tells about it is the next message of the session
+		next.reader = bufio.NewReader(io.MultiReader(strings.NewReader(reply+"\n"), next.reader))
+	}
+
+	return next, nil
+}
+
+// SendSession tells the client how to resume the session
+func (t *TcpConn) SendSession(id string, token string) error {
+	return t.send(consts.Session + id + "," + token)
+}
+
+// GetSession learns how to resume the session, for a request asking for a resumable one
+func (t *TcpConn) GetSession() (string, string, error) {
+	reply, err := t.WaitReply()
+	if err != nil {
+		return "", "", err
+	}
+
+	id, token, ok := strings.Cut(strings.TrimPrefix(reply, consts.Session), ",")
+	if !strings.HasPrefix(reply, consts.Session) || !ok {
+		return "", "", fmt.Errorf("invalid session message %q", reply)
+	}
+
+	return id, token, nil
+}
+
+// SendResumed tells the client the session goes on on this connection
+func (t *TcpConn) SendResumed() error {
+	return t.send(consts.Resumed)
+}
@@ -0,0 +1,357 @@
+package tcpconn
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/cookie"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TcpConn is the control channel of a session. Both the sending and the receiving side use it,
+// whichever of client and server plays that role.
+// A resumable one outlives its connection: when the connection breaks, reads and writes wait for a new one
+// to replace it, see resume.go.
+type TcpConn struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader     // kept for the whole session so no buffered message is lost between two Wait
+	limit    *io.LimitedReader // between the connection and reader, bounds what a client not authenticated yet sends
+	migrated chan struct{}     // closed when a new connection replaced this one
+	resume   *resume           // nil unless the session can be resumed
+	proof    string            // answer to the challenge of the server, sent along with the request
+	closed   bool
+}
+
+func New(conn net.Conn) *TcpConn {
+	limit := &io.LimitedReader{R: conn, N: math.MaxInt64}
+	return &TcpConn{
+		conn:     conn,
+		reader:   bufio.NewReader(limit),
+		limit:    limit,
+		migrated: make(chan struct{}),
+	}
+}
+
+// current returns the connection in use, its reader, and what is closed once it is replaced
+func (t *TcpConn) current() (net.Conn, *bufio.Reader, chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conn, t.reader, t.migrated
+}
+
+func (t *TcpConn) send(msg string) error {
+	for {
+		conn, _, migrated := t.current()
+		_, err := conn.Write([]byte(msg + "\n"))
+		if err == nil || !t.await(migrated) {
+			return err
+		}
+	}
+}
+
+// Tell the other side which UDP ports we are listen to, comma separated, and after a semicolon the token every
+// datagram must start with
+func (t *TcpConn) SendPorts(ports []string, token string) {
+	err := t.send(strings.Join(ports, ",") + ";" + token)
+	if err != nil {
+		log.Println("Fail to tell user the ports. Error:", err)
+	} else {
+		log.Println("Told user the UDP ports are", ports)
+	}
+}
+
+// GetPorts learns which UDP ports the other side is listen to, and the token to send with the datagrams
+func (t *TcpConn) GetPorts() ([]string, string, error) {
+	reply, err := t.WaitReply()
+	if err != nil {
+		return nil, "", err
+	}
+
+	list, token, ok := strings.Cut(reply, ";")
+	if !ok || len(list) == 0 || len(token) == 0 {
+		return nil, "", fmt.Errorf("Invalid udp port list %q", reply)
+	}
+
+	ports := strings.Split(list, ",")
+	for _, port := range ports {
+		if len(port) == 0 {
+			return nil, "", fmt.Errorf("Invalid udp port list %q", reply)
+		}
+	}
+
+	log.Printf("Got UDP ports %s", list)
+	return ports, token, nil
+}
+
+// SendReady tells the sender we are ready to receive
+func (t *TcpConn) SendReady() {
+	if err := t.send("Server prepare ready"); err != nil {
+		log.Println("Fail to tell user we are ready. Error:", err)
+	}
+}
+
+// SendRequest sends the request, with the proof of the challenge answered by Answer
+func (t *TcpConn) SendRequest(request *model.Request) error {
+	request.Proof = t.proof
+	msg, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	if logged, err := json.Marshal(redacted(request)); err == nil {
+		log.Println("Send request", string(logged))
+	}
+	return t.send(string(msg))
+}
+
+// redacted is a copy of the request with its secrets hidden, to log it
+func redacted(request *model.Request) *model.Request {
+	copied := *request
+	for _, secret := range []*string{&copied.Password, &copied.APIToken, &copied.Token} {
+		if *secret != "" {
+			*secret = "***"
+		}
+	}
+
+	return &copied
+}
+
+// SendChallenge asks the client to prove it can be reached at its address and spent some work, before we spend
+// anything on it
+func (t *TcpConn) SendChallenge(challenge string) error {
+	return t.send(consts.Challenge + challenge)
+}
+
+// Answer solves the challenge the server greets every connection with, the proof goes with the request
+func (t *TcpConn) Answer() error {
+	reply, err := t.WaitReply()
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(reply, consts.Challenge) {
+		return fmt.Errorf("expect a challenge, got %q", reply)
+	}
+
+	t.proof, err = cookie.Solve(strings.TrimPrefix(reply, consts.Challenge))
+	return err
+}
+
+// GetRequest reads the first message of a connection. Nobody is authenticated yet, so a request longer than
+// consts.MaxRequestSize is refused before it takes more memory.
+func (t *TcpConn) GetRequest() (*model.Request, error) {
+	log.Println("Waiting for request")
+	t.limit.N = consts.MaxRequestSize
+	msg, err := t.Wait()
+	exhausted := t.limit.N == 0
+	t.limit.N = math.MaxInt64
+	if err != nil && exhausted {
+		return nil, fmt.Errorf("request longer than %d bytes", consts.MaxRequestSize)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	request := &model.Request{}
+	if err := json.Unmarshal([]byte(msg), request); err != nil {
+		return nil, fmt.Errorf("fail to parse request: %w", err)
+	}
+
+	return request, nil
+}
+
+func (t *TcpConn) SendManifest(manifest *fileoperator.Manifest) error {
+	msg, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Send manifest", manifest.String())
+	return t.send(string(msg))
+}
+
+func (t *TcpConn) GetManifest() (*fileoperator.Manifest, error) {
+	log.Println("Waiting for manifest")
+	info, err := t.WaitReply()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Raw manifest message", info)
+	manifest := &fileoperator.Manifest{}
+	if err := json.Unmarshal([]byte(info), manifest); err != nil {
+		return nil, fmt.Errorf("fail to parse manifest: %w", err)
+	}
+
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// SendResult answers a management request with one JSON message
+func (t *TcpConn) SendResult(result interface{}) error {
+	msg, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return t.send(string(msg))
+}
+
+// GetResult waits for the answer of a management request and decodes it into result
+func (t *TcpConn) GetResult(result interface{}) error {
+	msg, err := t.WaitReply()
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(msg), result); err != nil {
+		return fmt.Errorf("fail to parse result: %w", err)
+	}
+
+	return nil
+}
+
+// SendError tells the other side why we cannot serve the request
+func (t *TcpConn) SendError(cause error) {
+	msg := consts.Error + strings.ReplaceAll(cause.Error(), "\n", " ")
+	err := t.send(msg)
+	if err != nil {
+		log.Printf("Fail to send error, Error: %s \n", err)
+	} else {
+		log.Printf("Told user the error: %s\n", msg)
+	}
+}
+
+func (t *TcpConn) SendFinishSignal() {
+	msg := consts.Finished
+	err := t.send(msg)
+	if err != nil {
+		log.Printf("Fail to send finish signal, Error: %s \n", err)
+	} else {
+		log.Printf("Told user we have finished.\n")
+	}
+}
+
+// SendMismatchSignal tells the sender the files whose checksum does not match
+func (t *TcpConn) SendMismatchSignal(files []string) {
+	names, _ := json.Marshal(files)
+	msg := consts.Mismatch + string(names)
+	err := t.send(msg)
+	if err != nil {
+		log.Printf("Fail to send mismatch signal, Error: %s \n", err)
+	} else {
+		log.Printf("Told user the checksum does not match.\n")
+	}
+}
+
+func (t *TcpConn) RequestPacket(index uint64) {
+	msg := fmt.Sprintf("%s%d", consts.NeedPacket, index)
+	err := t.send(msg)
+	if err != nil {
+		log.Printf("Fail to request packet %d. Error: %s \n", index, err)
+	} else {
+		log.Printf("Told user to send the packet %d again. Msg: %s\n", index, msg)
+	}
+}
+
+func (t *TcpConn) RequestValidation() error {
+	err := t.send(consts.Validate)
+	if err != nil {
+		log.Println("Fail to ask server to validate", err)
+		return err
+	} else {
+		log.Println("Asked server to validate")
+	}
+
+	return nil
+}
+
+func (t *TcpConn) Wait() (string, error) {
+	_, reader, migrated := t.current()
+	message, err := reader.ReadString('\n')
+	for err != nil && t.await(migrated) {
+		_, reader, migrated = t.current()
+		message, err = reader.ReadString('\n')
+	}
+
+	if err != nil {
+		log.Println(err)
+		return err.Error(), err
+	}
+
+	if len(message) == 0 {
+		return message, nil
+	}
+
+	return message[:len(message)-1], nil
+}
+
+// Pending tells whether another message already arrived after the one just read
+func (t *TcpConn) Pending() bool {
+	_, reader, _ := t.current()
+	return reader.Buffered() > 0
+}
+
+// WaitReply waits for the next message and turns an error message of the other side into an error
+func (t *TcpConn) WaitReply() (string, error) {
+	message, err := t.Wait()
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(message, consts.Error) {
+		return "", errors.New(strings.TrimPrefix(message, consts.Error))
+	}
+
+	return message, nil
+}
+
+func (t *TcpConn) GetLocalInfo() string {
+	conn, _, _ := t.current()
+	return conn.LocalAddr().String()
+}
+
+// RemoteAddr returns the address of the other side, the one of the latest connection when it moved
+func (t *TcpConn) RemoteAddr() string {
+	conn, _, _ := t.current()
+	return conn.RemoteAddr().String()
+}
+
+// RemoteHost returns the IP address of the other side, the one of the latest connection when it moved
+func (t *TcpConn) RemoteHost() string {
+	conn, _, _ := t.current()
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+func (t *TcpConn) Close() {
+	t.mu.Lock()
+	if t.resume != nil && !t.closed {
+		close(t.resume.done)
+	}
+	t.closed = true
+	conn := t.conn
+	t.mu.Unlock()
+
+	if err := conn.Close(); err != nil {
+		log.Println(err)
+	}
+}
@@ -3,6 +3,7 @@ package toggle
 var SerialWrite bool = true
 var SerialRead bool = false
 var MultiThreadEmit bool = true
+var UDPOffload bool = true // use UDP GSO and GRO where the kernel has them
 
 type Mode string
 
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"io"
+)
+
+const (
+	// after this many chunks in a row did not get smaller we stop trying for a while, the data is likely
+	// already compressed
+	bypassAfter = 16
+	// how many chunks we send raw before trying again
+	bypassFor = 256
+)
+
+// compressor compresses every chunk on its own, a lost packet must not make the following ones unreadable
+type compressor struct {
+	buffer bytes.Buffer
+	writer *flate.Writer
+	misses int // chunks in a row that did not get smaller
+	bypass int // chunks left to send raw without trying
+}
+
+// newCompressor returns nil for consts.CompressionNone, compress on a nil compressor sends every chunk raw
+func newCompressor(codec string) *compressor {
+	if codec != consts.CompressionDeflate {
+		return nil
+	}
+
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &compressor{writer: writer}
+}
+
+// compress returns the data to put on the wire and whether it is compressed
+func (c *compressor) compress(data []byte) ([]byte, bool) {
+	if c == nil || len(data) == 0 {
+		return data, false
+	}
+
+	if c.bypass > 0 {
+		c.bypass--
+		return data, false
+	}
+
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+	c.writer.Write(data)
+	c.writer.Close()
+	if c.buffer.Len() >= len(data) {
+		c.misses++
+		if c.misses >= bypassAfter {
+			c.misses = 0
+			c.bypass = bypassFor
+		}
+		return data, false
+	}
+
+	c.misses = 0
+	return c.buffer.Bytes(), true
+}
+
+// decompressor inflates chunks into buffers of the caller. It keeps its inflater from chunk to chunk,
+// so one is needed per go routine.
+type decompressor struct {
+	source bytes.Reader
+	reader io.ReadCloser
+	extra  [1]byte
+}
+
+// decompress inflates data into dst, refusing anything bigger than dst
+func (d *decompressor) decompress(data []byte, dst []byte) ([]byte, error) {
+	d.source.Reset(data)
+	if d.reader == nil {
+		d.reader = flate.NewReader(&d.source)
+	} else if err := d.reader.(flate.Resetter).Reset(&d.source, nil); err != nil {
+		return nil, fmt.Errorf("inflate hit error: %w", err)
+	}
+
+	n, err := io.ReadFull(d.reader, dst)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return dst[:n], nil
+	case nil:
+		// dst is full, the stream has to end here
+		m, err := d.reader.Read(d.extra[:])
+		if m > 0 {
+			return nil, fmt.Errorf("inflated chunk is bigger than %d bytes", len(dst))
+		}
+
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("inflate hit error: %w", err)
+		}
+		return dst, nil
+	default:
+		return nil, fmt.Errorf("inflate hit error: %w", err)
+	}
+}
@@ -0,0 +1,37 @@
+package transfer
+
+import (
+	"time"
+)
+
+// pacer spaces out emitted packets so the average send rate stays below a limit.
+// A nil pacer does not limit anything.
+type pacer struct {
+	bytesPerSecond float64
+	start          time.Time
+	sent           float64
+}
+
+func newPacer(mbitPerSecond float64) *pacer {
+	if mbitPerSecond <= 0 {
+		return nil
+	}
+
+	return &pacer{
+		bytesPerSecond: mbitPerSecond * 1000 * 1000 / 8,
+		start:          time.Now(),
+	}
+}
+
+// Wait blocks until n more bytes can be sent without exceeding the rate limit
+func (p *pacer) Wait(n int) {
+	if p == nil {
+		return
+	}
+
+	p.sent += float64(n)
+	due := p.start.Add(time.Duration(p.sent / p.bytesPerSecond * float64(time.Second)))
+	if delay := time.Until(due); delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,197 @@
+package transfer
+
+import (
+	"github.com/gtxistxgao/safe-udp/common/udp_client"
+	"log"
+	"sync"
+)
+
+// Path is one way to the receiver: the UDP clients bound to one local address, one per port of the receiver
+type Path struct {
+	Local   string // local address the clients send from, empty for the default route
+	Clients []*udp_client.UDPClient
+}
+
+func (p *Path) Close() {
+	for _, c := range p.Clients {
+		c.Close()
+	}
+}
+
+func (p *Path) name() string {
+	if p.Local == "" {
+		return "default route"
+	}
+
+	return p.Local
+}
+
+const (
+	minPathWeight = 0.05 // a degraded path keeps a trickle of batches, so we notice when it recovers
+	lossDecrease  = 0.7  // weight kept when the receiver asks again for a chunk sent on the path
+	errorDecrease = 0.5  // weight kept when sending on the path failed
+	sentIncrease  = 0.01 // weight won back with every batch sent
+	// how many of the chunks sent last we remember the path of, to blame the right one for a loss
+	sentOnSize = 1 << 16
+)
+
+// pathState is the congestion state of a path
+type pathState struct {
+	*Path
+	next   int     // client sending the next batch, the batches of a path are striped over its clients
+	weight float64 // share of the batches, in [minPathWeight, 1]
+	clock  float64 // grows by 1/weight with every batch, the path with the smallest sends next
+	losses int
+}
+
+// scheduler spreads the batches over the paths by their weight. Losses and send errors on a path shrink its weight
+// so the other paths take over its share, every batch sent on it grows it back.
+type scheduler struct {
+	mu     sync.Mutex // the emitting go routine sends while the feedback one reports losses
+	paths  []*pathState
+	sentOn []uint8 // path of the chunks sent last, by index modulo sentOnSize
+}
+
+func newScheduler(paths []*Path) *scheduler {
+	s := &scheduler{}
+	s.set(paths)
+	return s
+}
+
+// replace swaps the paths for new ones, after the receiver moved, and returns the old ones
+func (s *scheduler) replace(paths []*Path) []*Path {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.list()
+	s.set(paths)
+	return old
+}
+
+// current returns the paths in use
+func (s *scheduler) current() []*Path {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.list()
+}
+
+func (s *scheduler) list() []*Path {
+	paths := make([]*Path, 0, len(s.paths))
+	for _, p := range s.paths {
+		paths = append(paths, p.Path)
+	}
+
+	return paths
+}
+
+func (s *scheduler) set(paths []*Path) {
+	s.paths = s.paths[:0]
+	for _, p := range paths {
+		s.paths = append(s.paths, &pathState{Path: p, weight: 1})
+	}
+
+	if len(paths) > 1 && s.sentOn == nil {
+		s.sentOn = make([]uint8, sentOnSize)
+	}
+}
+
+// pick returns the path and the client of it to send the next batch with
+func (s *scheduler) pick() (*pathState, *udp_client.UDPClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.paths[0]
+	for _, candidate := range s.paths[1:] {
+		if candidate.clock < p.clock {
+			p = candidate
+		}
+	}
+
+	client := p.Clients[p.next]
+	p.next = (p.next + 1) % len(p.Clients)
+	p.clock += 1 / p.weight
+	return p, client
+}
+
+// sent records the chunks of a batch sent on the path, err is the outcome of sending it
+func (s *scheduler) sent(p *pathState, indices []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.paths) == 1 {
+		return
+	}
+
+	if err != nil {
+		s.degrade(p, errorDecrease)
+		log.Printf("Sending on %s failed, its weight is now %.2f. %s\n", p.name(), p.weight, err)
+		return
+	}
+
+	for _, index := range indices {
+		s.sentOn[index%sentOnSize] = uint8(s.position(p))
+	}
+
+	p.weight += sentIncrease
+	if p.weight > 1 {
+		p.weight = 1
+	}
+}
+
+// lost blames the path the chunk was sent on last for the receiver asking for it again
+func (s *scheduler) lost(index uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.paths) == 1 {
+		return
+	}
+
+	position := int(s.sentOn[index%sentOnSize])
+	if position >= len(s.paths) {
+		position = 0 // sent before the paths were replaced
+	}
+
+	p := s.paths[position]
+	p.losses++
+	s.degrade(p, lossDecrease)
+	log.Printf("Chunk %d lost on %s, its weight is now %.2f\n", index, p.name(), p.weight)
+}
+
+func (s *scheduler) degrade(p *pathState, factor float64) {
+	p.weight *= factor
+	if p.weight < minPathWeight {
+		p.weight = minPathWeight
+	}
+
+	// a degraded path waits for the others to catch up before its next batch
+	for _, other := range s.paths {
+		if other.clock > p.clock {
+			p.clock = other.clock
+		}
+	}
+}
+
+func (s *scheduler) position(p *pathState) int {
+	for i, candidate := range s.paths {
+		if candidate == p {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// report logs how the batches ended up spread over the paths
+func (s *scheduler) report() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.paths) == 1 {
+		return
+	}
+
+	for _, p := range s.paths {
+		log.Printf("Path %s: weight %.2f, %d chunks lost\n", p.name(), p.weight, p.losses)
+	}
+}
@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"strconv"
+)
+
+// compressedFlag sits between the index and the data of a compressed chunk. Neither the token nor base64 have a
+// comma, so a raw chunk has two commas and a compressed one three.
+const compressedFlag = "z"
+
+// appendPayLoad frames a chunk into a datagram appended to dst: the session token the receiver gave, the decimal
+// index and the base64 encoded data, separated by commas. A compressed chunk reads "<token>,<index>,z,<data>".
+func appendPayLoad(dst []byte, token string, chunk []byte, index uint64, compressed bool) []byte {
+	dst = append(dst, token...)
+	dst = append(dst, ',')
+	dst = strconv.AppendUint(dst, index, 10)
+	dst = append(dst, ',')
+	if compressed {
+		dst = append(dst, compressedFlag...)
+		dst = append(dst, ',')
+	}
+
+	start := len(dst)
+	size := base64.StdEncoding.EncodedLen(len(chunk))
+	if cap(dst)-start < size {
+		grown := make([]byte, start, start+size)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	dst = dst[:start+size]
+	base64.StdEncoding.Encode(dst[start:], chunk)
+	return dst
+}
+
+// parsePayLoad is the reverse of appendPayLoad, it decodes the data into c.Data, which must have room for a
+// chunk. The data of a compressed chunk is left compressed. The token was checked by the UDP server already.
+func parsePayLoad(data []byte, c *model.Chunk) (bool, error) {
+	token := bytes.IndexByte(data, ',')
+	if token < 0 {
+		return false, fmt.Errorf("no token in packet of %d bytes", len(data))
+	}
+	data = data[token+1:]
+
+	sep := bytes.IndexByte(data, ',')
+	if sep < 0 {
+		return false, fmt.Errorf("no separator in packet of %d bytes", len(data))
+	}
+
+	index, err := parseIndex(data[:sep])
+	if err != nil {
+		return false, err
+	}
+
+	encodedData := data[sep+1:]
+	compressed := false
+	if flag := bytes.IndexByte(encodedData, ','); flag >= 0 {
+		if string(encodedData[:flag]) != compressedFlag {
+			return false, fmt.Errorf("unknown flag %q in chunk %d", encodedData[:flag], index)
+		}
+		compressed = true
+		encodedData = encodedData[flag+1:]
+	}
+
+	buffer := c.Data[:cap(c.Data)]
+	if base64.StdEncoding.DecodedLen(len(encodedData)) > len(buffer) {
+		return false, fmt.Errorf("chunk %d of %d encoded bytes is bigger than a chunk", index, len(encodedData))
+	}
+
+	n, err := base64.StdEncoding.Decode(buffer, encodedData)
+	if err != nil {
+		return false, fmt.Errorf("decode base64 hit error: %w", err)
+	}
+
+	c.Index = index
+	c.Data = buffer[:n]
+	return compressed, nil
+}
+
+// parseIndex is strconv.ParseUint without turning the bytes into a string
+func parseIndex(digits []byte) (uint64, error) {
+	if len(digits) == 0 || len(digits) > 20 {
+		return 0, fmt.Errorf("parse string to index hit error. String: %s", digits)
+	}
+
+	var index uint64
+	for _, d := range digits {
+		if d < '0' || d > '9' {
+			return 0, fmt.Errorf("parse string to index hit error. String: %s", digits)
+		}
+
+		next := index*10 + uint64(d-'0')
+		if next/10 != index {
+			return 0, fmt.Errorf("parse string to index hit error. String: %s Error: out of range", digits)
+		}
+		index = next
+	}
+
+	return index, nil
+}
+
+// chunkBufferSize is the room decoding a framed chunk of chunkSize bytes takes, base64 decodes up to two bytes
+// of padding more
+func chunkBufferSize(chunkSize int) int {
+	return base64.StdEncoding.DecodedLen(base64.StdEncoding.EncodedLen(chunkSize))
+}
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"testing"
+)
+
+const benchToken = "0123456789abcdef"
+
+func TestPayLoadRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("safe-udp"), consts.PayloadDataSizeByte/8)
+	for _, compressed := range []bool{false, true} {
+		frame := appendPayLoad(nil, benchToken, data, 1<<40, compressed)
+
+		c := &model.Chunk{Data: make([]byte, chunkBufferSize(consts.MaxPayloadDataSizeByte))}
+		gotCompressed, err := parsePayLoad(frame, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Index != 1<<40 || gotCompressed != compressed || !bytes.Equal(c.Data, data) {
+			t.Errorf("compressed %v: got chunk %d compressed %v of %d bytes", compressed, c.Index, gotCompressed, len(c.Data))
+		}
+	}
+}
+
+// framing a chunk into a buffer with room for it allocates nothing
+func BenchmarkAppendPayLoad(b *testing.B) {
+	data := make([]byte, consts.PayloadDataSizeByte)
+	frame := make([]byte, 0, consts.MaxChunkSize)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		frame = appendPayLoad(frame[:0], benchToken, data, uint64(i), false)
+	}
+}
+
+// decoding a datagram into the chunk's own buffer allocates nothing
+func BenchmarkParsePayLoad(b *testing.B) {
+	data := make([]byte, consts.PayloadDataSizeByte)
+	frame := appendPayLoad(nil, benchToken, data, 123456789, false)
+	c := &model.Chunk{Data: make([]byte, chunkBufferSize(consts.MaxPayloadDataSizeByte))}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if _, err := parsePayLoad(frame, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package transfer
+
+import (
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"sync"
+)
+
+// freeChunkCount bounds how many chunk buffers a receiver keeps for reuse, enough for the chunks in flight
+// between the workers. Chunks waiting out of order in the heap beyond that go to the garbage collector.
+const freeChunkCount = 16 * consts.UDPBatchSize
+
+// chunkPool recycles the chunk structs travelling between the receiver workers
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		return &model.Chunk{}
+	},
+}
@@ -0,0 +1,389 @@
+package transfer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/bufpool"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/common/udp_server"
+	"github.com/gtxistxgao/safe-udp/common/util"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Receiver reassembles the chunks arriving on a UDP server into the files of a manifest,
+// and asks the sender over the control channel for the chunks it misses
+type Receiver struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	tcpConn    *tcpconn.TcpConn
+	udpServers []*udp_server.UDPServer // one receive go routine each, they share their buffers
+	manifest   *fileoperator.Manifest
+	progress   uint64               // the next packet index we are expecting, atomic: minHeapWorker moves it, sync reads it
+	saved      chan struct{}        // closed once every file of the manifest is written into disk
+	writer     *fileoperator.Writer // only touched by saveToDiskWorker until saved is closed
+	buffers    *bufpool.Pool        // chunk data, from decoding until the chunk is written or dropped
+	workers    int                  // decodeWorkers running
+	running    sync.WaitGroup       // every worker of the pipeline
+	stats      Stats
+	once       sync.Once
+	err        error // outcome of the transfer, set before the context is cancelled
+}
+
+// NewReceiver prepares a receiver, workers is the number of go routines decoding the datagrams and 0 runs one per CPU
+func NewReceiver(ctx context.Context, tcpConn *tcpconn.TcpConn, udpServers []*udp_server.UDPServer, manifest *fileoperator.Manifest, writer *fileoperator.Writer, workers int) *Receiver {
+	ctx, cancel := context.WithCancel(ctx)
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Receiver{
+		ctx:        ctx,
+		cancel:     cancel,
+		tcpConn:    tcpConn,
+		udpServers: udpServers,
+		manifest:   manifest,
+		saved:      make(chan struct{}),
+		writer:     writer,
+		buffers:    bufpool.New(chunkBufferSize(manifest.ChunkSize), freeChunkCount),
+		workers:    workers,
+	}
+}
+
+// newChunk takes a chunk with room for the data of one
+func (r *Receiver) newChunk() *model.Chunk {
+	c := chunkPool.Get().(*model.Chunk)
+	c.Data = r.buffers.Get()
+	return c
+}
+
+// release hands a chunk back once it is written or dropped
+func (r *Receiver) release(c *model.Chunk) {
+	r.buffers.Put(c.Data)
+	c.Data = nil
+	chunkPool.Put(c)
+}
+
+// Stats tells how many chunks arrived, how well they were compressed and how many datagrams were dropped
+func (r *Receiver) Stats() Stats {
+	stats := r.stats.snapshot()
+	stats.Foreign, stats.Forged = r.udpServers[0].Dropped() // the servers share their guard
+	return stats
+}
+
+// finish records the outcome of the transfer and stops the workers
+func (r *Receiver) finish(err error) {
+	r.once.Do(func() {
+		r.err = err
+		r.cancel()
+	})
+}
+
+// Run receives the files and blocks until they are all saved and verified, or the transfer failed
+func (r *Receiver) Run() error {
+	rawDataBufferCountLimit := (consts.MaxMemoryBufferMB * (1 << 20)) / r.manifest.ChunkSize
+	if rawDataBufferCountLimit > consts.PacketCountPerRound {
+		rawDataBufferCountLimit = consts.PacketCountPerRound
+	}
+
+	rawData := make(chan []byte, rawDataBufferCountLimit)
+	for _, server := range r.udpServers {
+		server := server
+		r.start(func() { r.serverWorker(r.ctx, server, rawData) })
+	}
+
+	processedData := make(chan *model.Chunk, rawDataBufferCountLimit)
+	for i := 0; i < r.workers; i++ {
+		r.start(func() { r.decodeWorker(r.ctx, rawData, processedData) })
+	}
+	log.Println(r.workers, "decodeWorkers started")
+
+	dataToBeWritten := make(chan *model.Chunk, 1)
+	r.start(func() { r.minHeapWorker(r.ctx, processedData, dataToBeWritten) })
+	log.Println("minHeapWorker started")
+
+	r.start(func() { r.saveToDiskWorker(r.ctx, dataToBeWritten) })
+	log.Println("saveToDiskWorker started")
+
+	go r.sync()
+
+	select {
+	case <-r.ctx.Done():
+		log.Println("Receiver finished task")
+	}
+
+	// the files are only closed once saveToDiskWorker stopped
+	r.running.Wait()
+	return r.err
+}
+
+// start runs a worker of the pipeline, Run waits for all of them to stop
+func (r *Receiver) start(worker func()) {
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		worker()
+	}()
+}
+
+func (r *Receiver) sync() {
+	signal := make(chan *bool, 1)
+	go func() {
+		for {
+			sig := <-signal
+			if sig == nil {
+				break
+			}
+
+			message, err := r.tcpConn.Wait()
+			if err != nil {
+				if strings.Contains(err.Error(), "use of closed network connection") {
+					log.Printf("Connection closed. Stop sync")
+					r.finish(fmt.Errorf("connection lost: %w", err))
+					break
+				}
+
+				// the connection broke and no new one replaced it in time
+				if err != io.EOF {
+					r.finish(fmt.Errorf("connection lost: %w", err))
+					break
+				}
+			}
+
+			log.Printf("Message received from sender %s\n", message)
+			r.triage(message)
+			signal <- util.BoolPtr(true)
+		}
+	}()
+
+	signal <- util.BoolPtr(true)
+
+	select {
+	case <-r.ctx.Done():
+		for len(signal) > 0 {
+			<-signal
+		}
+
+		signal <- nil
+		log.Println("sync finished")
+	}
+}
+
+func (r *Receiver) triage(msg string) {
+	switch msg {
+	case "beat":
+		log.Println("The sender is still there.")
+		break
+	case consts.Validate:
+		log.Println("Sender finished send all package. we need to do validation")
+		r.validate()
+		break
+	case "EOF":
+		log.Println("Connection closed by the sender. Cleaning up")
+		r.finish(fmt.Errorf("connection lost before all packets received"))
+		break
+	case "finish":
+		log.Println("All Validation is done. Cleaning up")
+		r.finish(nil)
+		break
+	default:
+		if strings.HasPrefix(msg, consts.Error) {
+			log.Println("The sender failed. Cleaning up")
+			r.finish(errors.New(strings.TrimPrefix(msg, consts.Error)))
+		}
+	}
+}
+
+func (r *Receiver) validate() {
+	progress := atomic.LoadUint64(&r.progress)
+	finished := progress == r.manifest.TotalPacketCount
+	if finished {
+		log.Printf("All required %d packets received\n", progress)
+		select {
+		case <-r.saved:
+		case <-r.ctx.Done():
+			return
+		}
+
+		// we can clean up  resources
+		if failed := r.writer.Failed(); len(failed) > 0 {
+			err := fmt.Errorf("%s", strings.Join(failed, "; "))
+			r.tcpConn.SendError(err)
+			r.finish(err)
+		} else if mismatched := r.writer.Mismatched(); len(mismatched) > 0 {
+			r.tcpConn.SendMismatchSignal(mismatched)
+			r.finish(fmt.Errorf("%w: %s", ErrMismatch, strings.Join(mismatched, ", ")))
+		} else {
+			r.tcpConn.SendFinishSignal()
+			r.finish(nil)
+		}
+	} else {
+		// hay we are not finished yet. send me this packet again!
+		r.tcpConn.RequestPacket(progress)
+	}
+}
+
+func (r *Receiver) serverWorker(ctx context.Context, server *udp_server.UDPServer, rawData chan []byte) {
+	if err := server.Run(ctx, rawData); err != nil && ctx.Err() == nil {
+		log.Println("Server Run hit error: ", err)
+		r.finish(err)
+	}
+}
+
+// decodeWorker turns datagrams into chunks. Several of them run, each with an inflater of its own, and hand
+// their chunks to minHeapWorker in whatever order they finish.
+func (r *Receiver) decodeWorker(ctx context.Context, rawData chan []byte, processedData chan *model.Chunk) {
+	var inflater decompressor
+	for {
+		var data []byte
+		select {
+		case <-ctx.Done():
+			return
+		case data = <-rawData:
+		}
+
+		c := r.decode(data, &inflater)
+		if c == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			r.release(c)
+			return
+		case processedData <- c:
+		}
+	}
+}
+
+// decode parses a datagram and inflates its data, it returns nil for a datagram to drop
+func (r *Receiver) decode(data []byte, inflater *decompressor) *model.Chunk {
+	c := r.newChunk()
+	compressed, err := parsePayLoad(data, c)
+	r.udpServers[0].Release(data) // parsePayLoad copied what it needs, any server takes it back
+	if err != nil {
+		log.Println("Drop packet. ", err)
+		r.release(c)
+		return nil
+	}
+
+	wireSize := len(c.Data)
+	if compressed {
+		if r.manifest.Compression == consts.CompressionNone {
+			log.Println("Drop packet. Chunk", c.Index, "is compressed but the sender announced no compression")
+			r.release(c)
+			return nil
+		}
+
+		buffer := r.buffers.Get()
+		inflated, err := inflater.decompress(c.Data, buffer[:r.manifest.ChunkSize])
+		r.buffers.Put(c.Data)
+		c.Data = buffer
+		if err != nil {
+			log.Println("Drop packet. ", err)
+			r.release(c)
+			return nil
+		}
+		c.Data = inflated
+	}
+	r.stats.add(len(c.Data), wireSize, compressed)
+
+	return c
+}
+
+// minHeapWorker puts the chunks back in order and hands them to saveToDiskWorker, asking for the missing ones
+func (r *Receiver) minHeapWorker(ctx context.Context, processedData chan *model.Chunk, dataToBeWritten chan *model.Chunk) {
+	minHeapChunk := &model.MinHeapChunk{}
+	heap.Init(minHeapChunk)
+
+	// chunks striped over several sockets arrive out of order, give the ones still on their way a chance
+	// before asking for them again
+	reorderWindow := (len(r.udpServers) - 1) * 2 * consts.UDPBatchSize
+	requested := false // we asked for the chunk at progress already
+	progress := uint64(0)
+
+	for {
+		var c *model.Chunk
+		select {
+		case <-ctx.Done():
+			fmt.Println("minHeapWorker cancelled")
+			return
+		case c = <-processedData:
+		}
+
+		heap.Push(minHeapChunk, c)
+
+		// remove duplicate package that we already processed
+		for !minHeapChunk.IsEmpty() && minHeapChunk.Peek().Index < progress {
+			r.release(heap.Pop(minHeapChunk).(*model.Chunk))
+		}
+
+		if minHeapChunk.IsEmpty() {
+			continue
+		}
+
+		topIndex := minHeapChunk.Peek().Index
+		if topIndex > progress {
+			if !requested && minHeapChunk.Len() > reorderWindow {
+				log.Printf("Expect index %d, but top package %d.\n", progress, topIndex)
+				r.tcpConn.RequestPacket(progress)
+				requested = true
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("minHeapWorker cancelled")
+			return
+		case dataToBeWritten <- heap.Pop(minHeapChunk).(*model.Chunk):
+		}
+		progress++
+		atomic.StoreUint64(&r.progress, progress)
+		requested = false
+	}
+}
+
+// saveToDiskWorker writes the chunks in order, it is the only one touching the writer until saved is closed
+func (r *Receiver) saveToDiskWorker(ctx context.Context, dataToBeWritten chan *model.Chunk) {
+	writer := r.writer
+	defer writer.Close()
+
+	if writer.Done() {
+		close(r.saved)
+	}
+
+	for {
+		var chunk *model.Chunk
+		select {
+		case <-ctx.Done():
+			fmt.Println("saveToDiskWorker cancelled")
+			return
+		case chunk = <-dataToBeWritten:
+		}
+
+		writeErr := writer.Write(chunk)
+		index := chunk.Index
+		r.release(chunk)
+		if writeErr != nil {
+			// the chunk counts as received already, asking for it again would not fill the gap it leaves
+			err := fmt.Errorf("fail to write chunk %d: %w", index, writeErr)
+			log.Println(err)
+			r.tcpConn.SendError(err)
+			r.finish(err)
+			return
+		} else if writer.Done() {
+			log.Printf("All %d chunks written into disk\n", r.manifest.TotalPacketCount)
+			close(r.saved)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/common/udp_server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a chunk that cannot be written fails the transfer and tells the sender, instead of asking for a chunk that
+// would be dropped as a duplicate
+func TestReceiverFailsOnWriteError(t *testing.T) {
+	manifest := &fileoperator.Manifest{
+		ChunkSize:        1000,
+		Files:            []fileoperator.FileMeta{{Name: "a", Size: 1500, Mode: 0644, TotalPacketCount: 2}},
+		Size:             1500,
+		TotalPacketCount: 2,
+	}
+	writer, err := fileoperator.NewWriter(t.TempDir(), manifest, fileoperator.ConflictFail, fileoperator.Ownership{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guard, err := udp_server.NewGuard("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := udp_server.Listen("127.0.0.1:0", 1, consts.MaxChunkSize, guard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer servers[0].Close()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	receiver := NewReceiver(context.Background(), tcpconn.New(local), servers, manifest, writer, 1)
+	done := make(chan error, 1)
+	go func() { done <- receiver.Run() }()
+
+	conn, err := net.Dial("udp", servers[0].LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(appendPayLoad(nil, guard.Token(), make([]byte, 1000), 0, false))
+	conn.Write(appendPayLoad(nil, guard.Token(), make([]byte, 600), 1, false)) // past the end of the file
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	message, err := bufio.NewReader(remote).ReadString('\n')
+	if err != nil || !strings.HasPrefix(message, consts.Error) {
+		t.Fatalf("the sender was told %q, %v, want an error", message, err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "chunk 1") {
+			t.Fatalf("got %v, want the write error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the receiver hangs")
+	}
+}
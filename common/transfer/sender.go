@@ -0,0 +1,393 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/common/toggle"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ModeMulti  = "multi"  // one go routine emits packets while another one serves the receiver's requests
+	ModeSingle = "single" // emit everything, then ask the receiver for validation, and repeat
+)
+
+// ErrMismatch means the receiver got every packet but the checksum of a saved file differs from the sender's
+var ErrMismatch = errors.New("checksum mismatch")
+
+// stopIndex tells readAndEmitWorker to stop, no session has that many chunks
+const stopIndex = math.MaxUint64
+
+// Sender emits the chunks of a manifest over UDP and resends what the receiver asks for over the control channel
+type Sender struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	tcpConn    *tcpconn.TcpConn
+	fileReader *fileoperator.Reader
+	paths      *scheduler // batches are spread over the paths by how well they do
+	token      string     // the receiver drops datagrams that do not start with it
+	mode       string
+	pacer      *pacer
+	compressor *compressor
+	chunk      []byte   // the chunk read last, reused chunk after chunk
+	buffers    [][]byte // one per datagram of a batch, reused batch after batch
+	payloads   [][]byte // framed chunks waiting in buffers to be sent
+	indices    []uint64 // index of every chunk in payloads
+	stats      Stats
+	once       sync.Once
+	err        error // outcome of the transfer, set before the context is cancelled
+}
+
+// NewSender prepares a sender emitting over the given paths with the token the receiver gave, rate is the emit
+// rate limit in Mbit/s and 0 means unlimited
+func NewSender(ctx context.Context, tcpConn *tcpconn.TcpConn, paths []*Path, token string, fileReader *fileoperator.Reader, mode string, rate float64) *Sender {
+	ctx, cancel := context.WithCancel(ctx)
+
+	buffers := make([][]byte, consts.UDPBatchSize)
+	for i := range buffers {
+		buffers[i] = make([]byte, 0, consts.MaxChunkSize)
+	}
+
+	return &Sender{
+		ctx:        ctx,
+		cancel:     cancel,
+		tcpConn:    tcpConn,
+		fileReader: fileReader,
+		paths:      newScheduler(paths),
+		token:      token,
+		mode:       mode,
+		pacer:      newPacer(rate),
+		compressor: newCompressor(fileReader.Manifest.Compression),
+		chunk:      make([]byte, fileReader.Manifest.ChunkSize),
+		buffers:    buffers,
+		payloads:   make([][]byte, 0, consts.UDPBatchSize),
+		indices:    make([]uint64, 0, consts.UDPBatchSize),
+	}
+}
+
+// Stats tells how many chunks were emitted and how well they were compressed
+func (s *Sender) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// queue compresses the chunk if the session does and it gets smaller, frames it into the next free buffer,
+// and sends the batch once every buffer is used.
+// Only one go routine emits at a time, so the compressor and the buffers need no lock.
+func (s *Sender) queue(index uint64, data []byte) error {
+	wire, compressed := s.compressor.compress(data)
+	s.stats.add(len(data), len(wire), compressed)
+	buffer := s.buffers[len(s.payloads)]
+	s.payloads = append(s.payloads, appendPayLoad(buffer[:0], s.token, wire, index, compressed))
+	s.indices = append(s.indices, index)
+	if len(s.payloads) < len(s.buffers) {
+		return nil
+	}
+
+	return s.flush()
+}
+
+// flush sends the queued chunks in one batch
+func (s *Sender) flush() error {
+	if len(s.payloads) == 0 {
+		return nil
+	}
+
+	size := 0
+	for _, payload := range s.payloads {
+		size += len(payload)
+	}
+
+	s.pacer.Wait(size)
+	path, client := s.paths.pick()
+	err := client.SendBatch(s.ctx, s.payloads)
+	s.paths.sent(path, s.indices, err)
+	s.payloads = s.payloads[:0]
+	s.indices = s.indices[:0]
+	return err
+}
+
+// Migrate carries on over new paths once the receiver, or we, moved to another address. The old paths are
+// closed, and the receiver tells again where it is as messages may have been lost with the old connection.
+func (s *Sender) Migrate(paths []*Path) {
+	for _, p := range s.paths.replace(paths) {
+		p.Close()
+	}
+
+	if err := s.tcpConn.RequestValidation(); err != nil {
+		log.Println("RequestValidation failed. ", err)
+	}
+}
+
+// Close closes the paths the sender emits over, the ones it migrated to included
+func (s *Sender) Close() {
+	for _, p := range s.paths.current() {
+		p.Close()
+	}
+}
+
+// finish records the outcome of the transfer and stops the workers
+func (s *Sender) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		s.cancel()
+	})
+}
+
+// Run sends the files and blocks until the receiver confirmed them or the transfer failed
+func (s *Sender) Run() error {
+	defer s.paths.report()
+	if s.mode == ModeSingle {
+		err := s.singleThreadEmit()
+		s.finish(err)
+		return err
+	}
+
+	return s.multiThreadEmit()
+}
+
+func (s *Sender) multiThreadEmit() error {
+	indexChan := make(chan uint64, consts.UDPBatchSize)
+	log.Println("indexChan limit", consts.UDPBatchSize)
+
+	go s.readAndEmitWorker(indexChan)
+	log.Println("readAndEmitWorker started.")
+	go s.feedbackWorker(indexChan)
+	log.Println("feedbackWorker started.")
+
+	if err := s.tcpConn.RequestValidation(); err != nil {
+		log.Println("RequestValidation failed. ", err)
+	}
+
+	select {
+	case <-s.ctx.Done():
+		log.Println("full cycle done cancelled")
+	}
+
+	return s.err
+}
+
+func (s *Sender) feedbackWorker(indexChan chan uint64) {
+	go func() {
+		for {
+			signal, err := s.tcpConn.Wait()
+			if err != nil {
+				log.Println(err)
+				if strings.Contains(err.Error(), "use of closed network connection") || err == io.EOF {
+					s.finish(fmt.Errorf("connection lost: %w", err))
+					break
+				}
+				continue
+			}
+
+			log.Println("Receiver is asking", signal)
+
+			if strings.HasPrefix(signal, consts.Finished) {
+				log.Println("Finished, cancel context")
+				s.finish(nil)
+				log.Println("Fully cancelled")
+				break
+			}
+
+			if strings.HasPrefix(signal, consts.Mismatch) {
+				log.Println("Receiver reported checksum mismatch, cancel context")
+				s.finish(mismatchError(signal))
+				break
+			}
+
+			if strings.HasPrefix(signal, consts.Error) {
+				log.Println("Receiver failed, cancel context")
+				s.finish(errors.New(strings.TrimPrefix(signal, consts.Error)))
+				break
+			}
+
+			if strings.HasPrefix(signal, consts.NeedPacket) {
+				// a newer answer is already waiting, resending for this one would only flood the receiver
+				if s.tcpConn.Pending() {
+					log.Println("Skip stale", signal)
+					continue
+				}
+
+				index := extractPacketIndex(signal)
+				s.paths.lost(index)
+
+				log.Printf("User is requesting chunk of %d/%d", index, s.fileReader.Manifest.TotalPacketCount-1)
+
+				for walker := index; walker < s.fileReader.Manifest.TotalPacketCount && walker < index+consts.PacketCountPerRound; walker++ {
+					select {
+					case indexChan <- walker:
+					case <-s.ctx.Done():
+						return
+					}
+				}
+
+				log.Println("Asking receiver do validation")
+				if err := s.tcpConn.RequestValidation(); err != nil {
+					log.Println("RequestValidation failed. ", err)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		log.Println("feedbackWorker cancelled")
+	}
+}
+
+// mismatchError turns the receiver's mismatch signal into an error naming the corrupted files
+func mismatchError(signal string) error {
+	var files []string
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(signal, consts.Mismatch)), &files); err != nil || len(files) == 0 {
+		return ErrMismatch
+	}
+
+	return fmt.Errorf("%w: %s", ErrMismatch, strings.Join(files, ", "))
+}
+
+func extractPacketIndex(msg string) uint64 {
+	packetIndexStr := strings.TrimPrefix(msg, consts.NeedPacket)
+	index, err := strconv.ParseUint(packetIndexStr, 10, 64)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return index
+}
+
+func (s *Sender) readAndEmitWorker(indexChan chan uint64) {
+	go func() {
+		for {
+			index := <-indexChan
+			stop := index == stopIndex
+			waiting := true
+			var err error
+			for waiting && !stop && err == nil {
+				bytesread := s.fileReader.ReadChunk(index, s.chunk)
+				err = s.queue(index, bytesread)
+
+				// what is already waiting goes in the same batch
+				select {
+				case index = <-indexChan:
+					stop = index == stopIndex
+				default:
+					waiting = false
+				}
+			}
+
+			if err == nil {
+				err = s.flush()
+			}
+
+			// keep going, the receiver asks again for what was lost. Stopping here would leave feedbackWorker
+			// blocked on indexChan before it reads the receiver's final answer.
+			if err != nil {
+				fmt.Print(err)
+			}
+
+			if stop {
+				break
+			}
+		}
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		for len(indexChan) > 0 {
+			<-indexChan
+		}
+
+		indexChan <- stopIndex
+		log.Println("readAndEmitWorker cancelled")
+	}
+}
+
+func (s *Sender) singleThreadEmit() error {
+	progress := fmt.Sprintf("%s%d", consts.NeedPacket, 0)
+	for round := 0; strings.HasPrefix(progress, consts.NeedPacket); round++ {
+		strArr := strings.Split(progress, ":")
+		index, err := strconv.ParseUint(strArr[1], 10, 64)
+		if err != nil {
+			log.Printf("Fail to parse progress index value. %s. Error: %s. \n", progress, err)
+			index = 0 // if cannot find, then start by 0 index
+		}
+
+		if round > 0 {
+			s.paths.lost(index)
+		}
+
+		if toggle.SerialRead {
+			s.serialReadAndEmit(index)
+		} else {
+			s.skipReadAndEmit(index)
+		}
+
+		log.Println("Asking receiver do validation")
+		if err := s.tcpConn.RequestValidation(); err != nil {
+			log.Println("RequestValidation failed. ", err)
+		}
+
+		progress, err = s.tcpConn.Wait()
+		// only the newest request counts, the older ones asked for what we just sent again
+		for err == nil && strings.HasPrefix(progress, consts.NeedPacket) && s.tcpConn.Pending() {
+			log.Println("Skip stale", progress)
+			progress, err = s.tcpConn.Wait()
+		}
+
+		if err != nil {
+			return fmt.Errorf("fail to get validation result: %w", err)
+		}
+	}
+
+	if strings.HasPrefix(progress, consts.Mismatch) {
+		return mismatchError(progress)
+	}
+
+	if strings.HasPrefix(progress, consts.Error) {
+		return errors.New(strings.TrimPrefix(progress, consts.Error))
+	}
+
+	if !strings.HasPrefix(progress, consts.Finished) {
+		return fmt.Errorf("unexpected validation result %q", progress)
+	}
+
+	return nil
+}
+
+func (s *Sender) serialReadAndEmit(start uint64) {
+	s.fileReader.ReadSerial(start, func(index uint64, data []byte) bool {
+		err := s.queue(index, data)
+		if err != nil {
+			fmt.Print(err)
+		}
+
+		return s.ctx.Err() == nil
+	})
+
+	if err := s.flush(); err != nil {
+		fmt.Print(err)
+	}
+}
+
+func (s *Sender) skipReadAndEmit(index uint64) {
+	for ; index < s.fileReader.Manifest.TotalPacketCount; index++ {
+		bytesread := s.fileReader.ReadChunk(index, s.chunk)
+		err := s.queue(index, bytesread)
+		if err != nil {
+			fmt.Print(err)
+		}
+	}
+
+	if err := s.flush(); err != nil {
+		fmt.Print(err)
+	}
+}
@@ -0,0 +1,54 @@
+package transfer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Stats counts the chunks a sender emitted or a receiver accepted, retransmissions included
+type Stats struct {
+	Chunks     uint64
+	Compressed uint64 // chunks that went compressed
+	DataBytes  uint64 // chunk data before compression
+	WireBytes  uint64 // chunk data as it went on the wire, before base64
+	Foreign    uint64 // datagrams the receiver dropped as they came from another address than the sender's
+	Forged     uint64 // datagrams the receiver dropped as they had no valid session token
+}
+
+// add is safe to call from several workers
+func (s *Stats) add(dataSize int, wireSize int, compressed bool) {
+	atomic.AddUint64(&s.Chunks, 1)
+	atomic.AddUint64(&s.DataBytes, uint64(dataSize))
+	atomic.AddUint64(&s.WireBytes, uint64(wireSize))
+	if compressed {
+		atomic.AddUint64(&s.Compressed, 1)
+	}
+}
+
+func (s *Stats) snapshot() Stats {
+	return Stats{
+		Chunks:     atomic.LoadUint64(&s.Chunks),
+		Compressed: atomic.LoadUint64(&s.Compressed),
+		DataBytes:  atomic.LoadUint64(&s.DataBytes),
+		WireBytes:  atomic.LoadUint64(&s.WireBytes),
+	}
+}
+
+// Ratio is how many bytes of data one byte on the wire carried
+func (s Stats) Ratio() float64 {
+	if s.WireBytes == 0 {
+		return 1
+	}
+
+	return float64(s.DataBytes) / float64(s.WireBytes)
+}
+
+func (s Stats) String() string {
+	text := fmt.Sprintf("%d chunks, %d compressed. %d bytes of data as %d bytes on the wire, ratio %.2f",
+		s.Chunks, s.Compressed, s.DataBytes, s.WireBytes, s.Ratio())
+	if s.Foreign > 0 || s.Forged > 0 {
+		text += fmt.Sprintf(". Dropped %d foreign and %d forged datagrams", s.Foreign, s.Forged)
+	}
+
+	return text
+}
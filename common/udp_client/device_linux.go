@@ -0,0 +1,23 @@
+package udp_client
+
+import (
+	"golang.org/x/sys/unix"
+	"log"
+	"syscall"
+)
+
+// bindToDevice makes a socket send through the interface whatever the routes say, SO_BINDTODEVICE. Kernels before
+// 5.7 want CAP_NET_RAW for it: without, the socket only sends from the address and routing rules decide.
+func bindToDevice(device string) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		if controlErr := c.Control(func(fd uintptr) { err = unix.BindToDevice(int(fd), device) }); controlErr != nil {
+			return controlErr
+		}
+
+		if err != nil {
+			log.Printf("Fail to bind to %s, source routing rules must send its address through it. Error: %s\n", device, err)
+		}
+		return nil
+	}
+}
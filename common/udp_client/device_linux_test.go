@@ -0,0 +1,34 @@
+package udp_client
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"testing"
+	"time"
+)
+
+// a client from an interface is bound to it, the routes no longer pick where its datagrams leave
+func TestNewFromBindsToDevice(t *testing.T) {
+	c := NewFrom(context.Background(), "127.0.0.1", "lo", "127.0.0.1:9", time.Second)
+	if c == nil {
+		t.Fatal("fail to create the client")
+	}
+	defer c.Close()
+
+	raw, err := c.conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var device string
+	raw.Control(func(fd uintptr) {
+		device, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device != "lo" {
+		t.Errorf("bound to %q, want lo", device)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package udp_client
+
+import (
+	"syscall"
+)
+
+// bindToDevice is Linux only, elsewhere a socket only sends from the address of the interface and source routing
+// rules must send that address through it
+func bindToDevice(device string) func(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -4,18 +4,49 @@ import (
 	"context"
 	"fmt"
 	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/toggle"
+	"github.com/gtxistxgao/safe-udp/common/udpbatch"
 	"log"
 	"net"
 	"syscall"
 	"time"
 )
 
+const (
+	// the kernel splits one buffer into at most this many datagrams
+	maxSegments = 64
+	// a segmented buffer is sent as one UDP datagram to the stack, it cannot be bigger than one
+	maxSegmentedSize = 65000
+)
+
 type UDPClient struct {
 	conn         *net.UDPConn
+	batch        udpbatch.Conn // nil where sendmmsg is not available
+	messages     []udpbatch.Message
+	gso          bool     // the kernel segments our buffers into datagrams, UDP_SEGMENT
+	segmented    [][]byte // one buffer of datagrams per message, for GSO
+	oob          [][]byte // the segmentation control message of each message
 	timeoutLimit time.Duration
 }
 
 func New(ctx context.Context, address string, timeoutLimit time.Duration) *UDPClient {
+	return NewFrom(ctx, "", "", address, timeoutLimit)
+}
+
+// NewFrom creates a client sending from the given local IP. The routes still pick the interface the datagrams
+// leave through: a device binds the socket to that interface on Linux, elsewhere source routing rules must send
+// the address through its interface. An empty local lets the system pick by the default route.
+func NewFrom(ctx context.Context, local string, device string, address string, timeoutLimit time.Duration) *UDPClient {
+	var laddr *net.UDPAddr
+	if local != "" {
+		ip := net.ParseIP(local)
+		if ip == nil {
+			fmt.Printf("invalid local address %q\n", local)
+			return nil
+		}
+		laddr = &net.UDPAddr{IP: ip}
+	}
+
 	// Resolve the UDP address so that we can make use of DialUDP
 	// with an actual IP and port instead of a name (in case a
 	// hostname is specified).
@@ -30,16 +61,66 @@ func New(ctx context.Context, address string, timeoutLimit time.Duration) *UDPCl
 	// a `connect(2)` syscall for a socket of type SOCK_DGRAM:
 	// - it forces the underlying socket to only read and write
 	//   to and from a specific remote address.
-	conn, err := net.DialUDP("udp", nil, raddr)
+	dialer := &net.Dialer{}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	if device != "" {
+		dialer.Control = bindToDevice(device)
+	}
+
+	dialed, err := dialer.DialContext(ctx, "udp", raddr.String())
 	if err != nil {
 		fmt.Print(err)
 		return nil
 	}
+	conn := dialed.(*net.UDPConn)
 
-	return &UDPClient{
+	messages := make([]udpbatch.Message, consts.UDPBatchSize)
+	for i := range messages {
+		messages[i].Buffers = make([][]byte, 1)
+	}
+
+	c := &UDPClient{
 		conn:         conn,
+		batch:        udpbatch.New(conn),
+		messages:     messages,
 		timeoutLimit: timeoutLimit,
 	}
+
+	if c.batch != nil && toggle.UDPOffload && udpbatch.EnableGSO(conn) {
+		log.Println("UDP segmentation offload enabled")
+		c.gso = true
+		c.segmented = make([][]byte, consts.UDPBatchSize)
+		c.oob = make([][]byte, consts.UDPBatchSize)
+		for i := range c.segmented {
+			c.segmented[i] = make([]byte, 0, maxSegmentedSize)
+		}
+	}
+
+	return c
+}
+
+// DialAll creates a client from the local IP, bound to the device if any, to every port of the host, closing them
+// all if one fails. An empty local lets the system pick by the default route.
+func DialAll(ctx context.Context, local string, device string, host string, ports []string, timeoutLimit time.Duration) ([]*UDPClient, error) {
+	clients := make([]*UDPClient, 0, len(ports))
+	for _, port := range ports {
+		client := NewFrom(ctx, local, device, net.JoinHostPort(host, port), timeoutLimit)
+		if client == nil {
+			for _, c := range clients {
+				c.Close()
+			}
+			if local != "" {
+				return nil, fmt.Errorf("fail to create UDP client from %s for %s", local, net.JoinHostPort(host, port))
+			}
+			return nil, fmt.Errorf("fail to create UDP client for %s", net.JoinHostPort(host, port))
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
 }
 
 func (c *UDPClient) Close() {
@@ -58,39 +139,144 @@ func (c *UDPClient) GetBufferValue() int {
 	return value
 }
 
+// SendAsync writes one datagram. A write blocked longer than the timeout limit, because the socket buffer is
+// full, gives up on the datagram: the receiver will ask for it again.
 func (c *UDPClient) SendAsync(ctx context.Context, chunk []byte) error {
 	if len(chunk) > consts.MaxChunkSize {
 		return fmt.Errorf("chunk size %d exceeded the max chunk size limit %d", len(chunk), consts.MaxChunkSize)
 	}
 
-	doneChan := make(chan error, 1)
-	go func() {
-		// It is possible that this action blocks, although this
-		// should only occur in very resource-intensive situations:
-		// - when you've filled up the socket buffer and the OS
-		//   can't dequeue the queue fast enough.
-		n, err := c.conn.Write(chunk)
-		if err != nil {
-			doneChan <- err
-			return
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeoutLimit))
+	_, err := c.conn.Write(chunk)
+	if isTimeout(err) {
+		fmt.Println("operation timeout")
+		return nil
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+// SendBatch writes the datagrams with as few system calls as the system allows, one per datagram where
+// sendmmsg is not available. The datagrams can be reused once it returns.
+func (c *UDPClient) SendBatch(ctx context.Context, chunks [][]byte) error {
+	if c.batch == nil {
+		for _, chunk := range chunks {
+			if err := c.SendAsync(ctx, chunk); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		log.Printf("packet-written: bytes=%d\n", n)
-		doneChan <- nil
-	}()
+	for _, chunk := range chunks {
+		if len(chunk) > consts.MaxChunkSize {
+			return fmt.Errorf("chunk size %d exceeded the max chunk size limit %d", len(chunk), consts.MaxChunkSize)
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeoutLimit))
+	if c.gso {
+		err := c.sendSegmented(ctx, chunks)
+		if !udpbatch.IsOffloadError(err) {
+			return err
+		}
+
+		// sending everything again is fine, the receiver drops the duplicates
+		log.Println("UDP segmentation offload failed, fall back to one datagram per message.", err)
+		c.gso = false
+	}
+
+	for i := range c.messages {
+		c.messages[i].OOB = nil
+	}
+
+	for len(chunks) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		messages := c.messages
+		if len(chunks) < len(messages) {
+			messages = messages[:len(chunks)]
+		}
+
+		for i := range messages {
+			messages[i].Buffers[0] = chunks[i]
+		}
+
+		n, err := c.batch.WriteBatch(messages, 0)
+		if isTimeout(err) {
+			fmt.Println("operation timeout")
+			return nil
+		}
 
-	select {
-	case <-ctx.Done():
-		fmt.Println("cancelled")
-		return ctx.Err()
-	case err := <-doneChan:
 		if err != nil {
 			fmt.Println(err)
 			return err
 		}
-	case <-time.After(c.timeoutLimit):
-		fmt.Println("operation timeout")
+
+		chunks = chunks[n:]
+	}
+
+	return nil
+}
+
+// sendSegmented packs runs of datagrams of the same size into one buffer each and lets the kernel split them,
+// so a whole run costs one trip through the stack. Only the last datagram of a run may be shorter.
+func (c *UDPClient) sendSegmented(ctx context.Context, chunks [][]byte) error {
+	for len(chunks) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		count := 0
+		for ; count < len(c.messages) && len(chunks) > 0; count++ {
+			size := len(chunks[0])
+			buffer := c.segmented[count][:0]
+			n := 0
+			for n < len(chunks) && n < maxSegments && len(chunks[n]) <= size && len(buffer)+len(chunks[n]) <= maxSegmentedSize {
+				buffer = append(buffer, chunks[n]...)
+				n++
+				if len(chunks[n-1]) < size {
+					break
+				}
+			}
+
+			c.segmented[count] = buffer
+			c.messages[count].Buffers[0] = buffer
+			c.oob[count] = udpbatch.SegmentOOB(c.oob[count], size)
+			c.messages[count].OOB = c.oob[count]
+			chunks = chunks[n:]
+		}
+
+		for sent := 0; sent < count; {
+			n, err := c.batch.WriteBatch(c.messages[sent:count], 0)
+			if isTimeout(err) {
+				fmt.Println("operation timeout")
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			sent += n
+		}
 	}
 
 	return nil
 }
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
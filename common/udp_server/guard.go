@@ -0,0 +1,146 @@
+package udp_server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TokenSize is how many random bytes a session token has, it goes hex encoded in front of every datagram
+const TokenSize = 8
+
+// Guard only lets through the datagrams of the session's peer: sent from one of its addresses, and starting with
+// the token of the session followed by a comma. Anybody else who learns a port cannot inject chunks.
+type Guard struct {
+	mu      sync.RWMutex
+	peers   []net.IP
+	learned []net.IP // taken from datagrams carrying the token, kept when the peer moves
+	learn   int      // addresses the guard may still learn
+	token   []byte
+	foreign uint64 // dropped as they came from another address
+	forged  uint64 // dropped as they had no or a wrong token
+}
+
+// NewGuard makes a guard with a fresh token, for a peer that sends from the given hosts
+func NewGuard(hosts ...string) (*Guard, error) {
+	buffer := make([]byte, TokenSize)
+	if _, err := rand.Read(buffer); err != nil {
+		return nil, err
+	}
+
+	g := &Guard{token: []byte(hex.EncodeToString(buffer))}
+	g.Allow(hosts...)
+	return g, nil
+}
+
+// Token is what the sender puts in front of every datagram
+func (g *Guard) Token() string {
+	return string(g.token)
+}
+
+// Allow replaces the addresses the peer sends from, e.g. once it moved to another one
+func (g *Guard) Allow(hosts ...string) {
+	peers := make([]net.IP, 0, len(hosts))
+	for _, host := range hosts {
+		// a zone tells the interface of a link-local address, it is not part of the address
+		if zone := strings.IndexByte(host, '%'); zone >= 0 {
+			host = host[:zone]
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			peers = append(peers, ip)
+		}
+	}
+
+	g.mu.Lock()
+	g.peers = peers
+	g.mu.Unlock()
+}
+
+// Learn lets the guard take up to n more addresses from the first datagrams carrying the token. A peer sending
+// over extra uplinks only knows their local addresses, a NAT may send them on from another one.
+func (g *Guard) Learn(n int) {
+	g.mu.Lock()
+	g.learn = n
+	g.mu.Unlock()
+}
+
+// admit tells whether the datagram read from addr comes from the peer, and counts the ones that do not
+func (g *Guard) admit(addr net.Addr, data []byte) bool {
+	known := g.known(addr)
+	sep := bytes.IndexByte(data, ',')
+	if sep < 0 || subtle.ConstantTimeCompare(data[:sep], g.token) != 1 {
+		if !known {
+			atomic.AddUint64(&g.foreign, 1)
+		} else {
+			atomic.AddUint64(&g.forged, 1)
+		}
+		return false
+	}
+
+	if !known && !g.learnFrom(addr) {
+		atomic.AddUint64(&g.foreign, 1)
+		return false
+	}
+
+	return true
+}
+
+// learnFrom takes the address of a datagram with the token as one of the peer, as long as it may learn more
+func (g *Guard) learnFrom(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, peer := range g.learned {
+		if peer.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+
+	if g.learn <= 0 {
+		return false
+	}
+
+	g.learn--
+	g.learned = append(g.learned, append(net.IP(nil), udpAddr.IP...)) // the address may be reused for the next read
+	log.Println("Learned peer address", udpAddr.IP, "from a datagram with the session token")
+	return true
+}
+
+func (g *Guard) known(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, peer := range g.peers {
+		if peer.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+
+	for _, peer := range g.learned {
+		if peer.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dropped tells how many datagrams came from another address than the peer's, and how many had no valid token
+func (g *Guard) Dropped() (uint64, uint64) {
+	return atomic.LoadUint64(&g.foreign), atomic.LoadUint64(&g.forged)
+}
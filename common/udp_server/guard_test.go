@@ -0,0 +1,62 @@
+package udp_server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGuardAdmit(t *testing.T) {
+	guard, err := NewGuard("192.0.2.1", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard.Learn(1) // one extra path, behind a NAT
+
+	from := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 4000} }
+	valid := []byte(guard.Token() + ",0,data")
+	tests := []struct {
+		name    string
+		addr    string
+		data    []byte
+		admit   bool
+		foreign uint64 // counts after the datagram
+		forged  uint64
+	}{
+		{"peer", "192.0.2.1", valid, true, 0, 0},
+		{"told source", "10.0.0.2", valid, true, 0, 0},
+		{"peer without token", "192.0.2.1", []byte("0,data"), false, 0, 1},
+		{"peer with a wrong token", "192.0.2.1", []byte("0123456789abcdef,0,data"), false, 0, 2},
+		{"stranger without token", "198.51.100.7", []byte("0,data"), false, 1, 2},
+		{"NAT address with token", "203.0.113.5", valid, true, 1, 2},
+		{"NAT address again", "203.0.113.5", valid, true, 1, 2},
+		{"NAT address without token", "203.0.113.5", []byte("0,data"), false, 1, 3},
+		{"another address with token", "203.0.113.6", valid, false, 2, 3},
+	}
+	for _, test := range tests {
+		if got := guard.admit(from(test.addr), test.data); got != test.admit {
+			t.Errorf("%s: admit %v, want %v", test.name, got, test.admit)
+		}
+
+		if foreign, forged := guard.Dropped(); foreign != test.foreign || forged != test.forged {
+			t.Errorf("%s: dropped %d foreign and %d forged, want %d and %d", test.name, foreign, forged, test.foreign, test.forged)
+		}
+	}
+
+	// a move of the control connection keeps the learned address
+	guard.Allow("192.0.2.9")
+	if !guard.admit(from("203.0.113.5"), valid) || guard.admit(from("192.0.2.1"), valid) {
+		t.Error("moving replaces the told addresses only")
+	}
+}
+
+// without extra paths nothing is learned, a token alone does not let a datagram in
+func TestGuardLearnsNothingByDefault(t *testing.T) {
+	guard, err := NewGuard("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if guard.admit(&net.UDPAddr{IP: net.ParseIP("203.0.113.5")}, []byte(guard.Token()+",0,data")) {
+		t.Error("a datagram from another address is admitted")
+	}
+}
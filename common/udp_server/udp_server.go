@@ -3,17 +3,58 @@ package udp_server
 import (
 	"context"
 	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/bufpool"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/toggle"
+	"github.com/gtxistxgao/safe-udp/common/udpbatch"
 	"log"
 	"net"
 	"strings"
 )
 
+// freeBufferCount bounds how many released buffers we keep around
+const freeBufferCount = 4 * consts.UDPBatchSize
+
+const readBufferSize = 8 << 20
+
+// the biggest buffer of coalesced datagrams GRO hands us
+const groBufferSize = 65536
+
 type UDPServer struct {
 	packetConn    net.PacketConn
+	batch         udpbatch.Conn // nil where recvmmsg is not available
+	gro           bool          // the kernel coalesces datagrams into one buffer, UDP_GRO
 	maxBufferSize int
+	buffers       *bufpool.Pool // buffers handed back by Release, reused for the next datagrams
+	guard         *Guard        // nil lets every datagram through
 }
 
 func New(address string, maxBufferSize int) (*UDPServer, error) {
+	return listen(address, maxBufferSize, bufpool.New(maxBufferSize, freeBufferCount), nil)
+}
+
+// Listen opens count servers on ports of their own, for a session striping its chunks over several sockets.
+// They share their buffers, a datagram of any of them can be handed back to any, and the guard dropping the
+// datagrams of anybody but the peer.
+func Listen(address string, count int, maxBufferSize int, guard *Guard) ([]*UDPServer, error) {
+	buffers := bufpool.New(maxBufferSize, count*freeBufferCount)
+	servers := make([]*UDPServer, 0, count)
+	for i := 0; i < count; i++ {
+		server, err := listen(address, maxBufferSize, buffers, guard)
+		if err != nil {
+			for _, s := range servers {
+				s.Close()
+			}
+			return nil, err
+		}
+
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+func listen(address string, maxBufferSize int, buffers *bufpool.Pool, guard *Guard) (*UDPServer, error) {
 	// ListenPacket provides us a wrapper around ListenUDP so that
 	// we don't need to call `net.ResolveUDPAddr` and then subsequentially
 	// perform a `ListenUDP` with the UDP address.
@@ -30,9 +71,28 @@ func New(address string, maxBufferSize int) (*UDPServer, error) {
 
 	fmt.Println("Start to listen to: ", packetConn.LocalAddr().String())
 
+	var batch udpbatch.Conn
+	gro := false
+	if udpConn, ok := packetConn.(*net.UDPConn); ok {
+		batch = udpbatch.New(udpConn)
+		// room for the bursts of a batching sender, the kernel caps it to net.core.rmem_max
+		if err := udpConn.SetReadBuffer(readBufferSize); err != nil {
+			log.Println("Fail to set the read buffer size.", err)
+		}
+
+		if batch != nil && toggle.UDPOffload && udpbatch.EnableGRO(udpConn) {
+			log.Println("UDP receive offload enabled")
+			gro = true
+		}
+	}
+
 	return &UDPServer{
 		packetConn:    packetConn,
+		batch:         batch,
+		gro:           gro,
 		maxBufferSize: maxBufferSize,
+		buffers:       buffers,
+		guard:         guard,
 	}, nil
 }
 
@@ -49,6 +109,16 @@ func (s *UDPServer) GetPort() string {
 	return ipAndPort[len(ipAndPort)-1]
 }
 
+// Ports lists the ports of the servers, to tell the sender
+func Ports(servers []*UDPServer) []string {
+	ports := make([]string, 0, len(servers))
+	for _, s := range servers {
+		ports = append(ports, s.GetPort())
+	}
+
+	return ports
+}
+
 func (s *UDPServer) Close() error {
 	fmt.Printf("Close connection on %v", s.packetConn.LocalAddr())
 	fmt.Println()
@@ -59,37 +129,68 @@ func (s *UDPServer) Close() error {
 	return nil
 }
 
-// Run will continuelly receiving data and publish the data to rawData Channel
+// Dropped tells how many datagrams the guard dropped as they came from another address than the peer's, and how
+// many as they had no valid token
+func (s *UDPServer) Dropped() (uint64, uint64) {
+	if s.guard == nil {
+		return 0, 0
+	}
+
+	return s.guard.Dropped()
+}
+
+func (s *UDPServer) admit(addr net.Addr, data []byte) bool {
+	return s.guard == nil || s.guard.admit(addr, data)
+}
+
+// Release hands back a datagram published by Run once the consumer is done with it
+func (s *UDPServer) Release(data []byte) {
+	s.buffers.Put(data)
+}
+
+// Run will continuelly receiving data and publish the data to rawData Channel.
+// Every datagram is a buffer of its own, the consumer hands it back with Release.
+// Once ctx is done the socket is closed, so the read blocked on it returns, and Run only returns once the
+// reading go routine stopped.
 func (s *UDPServer) Run(ctx context.Context, rawData chan []byte) error {
-	buffer := make([]byte, s.maxBufferSize)
 	doneChan := make(chan error, 1)
 	go func(output chan []byte) {
+		if s.batch != nil {
+			doneChan <- s.readBatches(ctx, output)
+			return
+		}
+
 		for {
 			// By reading from the connection into the buffer, we block until there's
 			// new content in the socket that we're listening for new packets.
 			//
 			// Whenever new packets arrive, `buffer` gets filled and we can continue
 			// the execution.
-			//
-			// note.: `buffer` is not being reset between runs.
-			//	  It's expected that only `n` reads are read from it whenever
-			//	  inspecting its contents.
+			buffer := s.buffers.Get()
 			n, addr, err := s.packetConn.ReadFrom(buffer)
 			if err != nil {
+				s.buffers.Put(buffer)
 				doneChan <- err
 				return
 			}
 
-			temp := make([]byte, n)
-			copy(temp, buffer[:n])
-			fmt.Printf("packet-received: bytes=%d from=%s\n", n, addr.String())
-			output <- temp
+			if !s.admit(addr, buffer[:n]) {
+				s.buffers.Put(buffer)
+				continue
+			}
+
+			if !s.publish(ctx, output, buffer[:n]) {
+				doneChan <- ctx.Err()
+				return
+			}
 		}
 	}(rawData)
 
 	select {
 	case <-ctx.Done():
 		fmt.Println("udp_server run done", ctx.Err())
+		s.packetConn.Close()
+		<-doneChan
 		return nil
 	case err := <-doneChan:
 		if err != nil {
@@ -100,3 +201,101 @@ func (s *UDPServer) Run(ctx context.Context, rawData chan []byte) error {
 
 	return nil
 }
+
+// publish hands a datagram to the consumer, or back to the pool once ctx is done as nobody reads any more
+func (s *UDPServer) publish(ctx context.Context, output chan []byte, data []byte) bool {
+	select {
+	case output <- data:
+		return true
+	case <-ctx.Done():
+		s.buffers.Put(data)
+		return false
+	}
+}
+
+// readBatches reads up to consts.UDPBatchSize datagrams per recvmmsg call
+func (s *UDPServer) readBatches(ctx context.Context, output chan []byte) error {
+	messages := make([]udpbatch.Message, consts.UDPBatchSize)
+	if s.gro {
+		return s.readCoalesced(ctx, output, messages)
+	}
+
+	for i := range messages {
+		messages[i].Buffers = [][]byte{s.buffers.Get()}
+	}
+	defer func() {
+		for i := range messages {
+			s.buffers.Put(messages[i].Buffers[0])
+		}
+	}()
+
+	for {
+		n, err := s.batch.ReadBatch(messages, 0)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			data := messages[i].Buffers[0][:messages[i].N]
+			if !s.admit(messages[i].Addr, data) {
+				continue // the buffer stays for the next batch
+			}
+
+			messages[i].Buffers[0] = s.buffers.Get()
+			if !s.publish(ctx, output, data) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// readCoalesced reads buffers the kernel may have filled with several datagrams of one flow, and splits them.
+// The big buffers stay here, every datagram is copied into a buffer of its own for the consumer.
+func (s *UDPServer) readCoalesced(ctx context.Context, output chan []byte, messages []udpbatch.Message) error {
+	oobSize := udpbatch.GROOOBSize()
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, groBufferSize)}
+		messages[i].OOB = make([]byte, oobSize)
+	}
+
+	for {
+		for i := range messages {
+			messages[i].OOB = messages[i].OOB[:oobSize]
+		}
+
+		n, err := s.batch.ReadBatch(messages, 0)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			data := messages[i].Buffers[0][:messages[i].N]
+			size := udpbatch.SegmentSize(messages[i].OOB[:messages[i].NN])
+			if size <= 0 {
+				size = len(data)
+			}
+
+			for len(data) > 0 {
+				segment := data
+				if len(segment) > size {
+					segment = data[:size]
+				}
+				data = data[len(segment):]
+
+				if len(segment) > s.maxBufferSize {
+					log.Printf("Drop datagram of %d bytes, bigger than %d\n", len(segment), s.maxBufferSize)
+					continue
+				}
+
+				if !s.admit(messages[i].Addr, segment) {
+					continue
+				}
+
+				buffer := s.buffers.Get()
+				if !s.publish(ctx, output, buffer[:copy(buffer, segment)]) {
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
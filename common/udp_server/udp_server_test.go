@@ -0,0 +1,53 @@
+package udp_server
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Run stops its reading go routine once cancelled, even when nobody takes the datagrams it read any more
+func TestRunStopsOnCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	server, err := New("127.0.0.1:0", 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rawData := make(chan []byte) // nobody reads
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx, rawData) }()
+
+	conn, err := net.Dial("udp", server.packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		conn.Write([]byte("chunk"))
+	}
+
+	time.Sleep(100 * time.Millisecond) // the reader blocks handing the first datagram over
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return once cancelled")
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d go routines left running, %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,80 @@
+package udpbatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"unsafe"
+)
+
+// EnableGSO tells whether the kernel can segment a buffer into datagrams for us (UDP_SEGMENT, Linux 4.18)
+func EnableGSO(conn *net.UDPConn) bool {
+	return control(conn, func(fd int) error {
+		_, err := unix.GetsockoptInt(fd, unix.SOL_UDP, unix.UDP_SEGMENT)
+		return err
+	})
+}
+
+// EnableGRO asks the kernel to hand us datagrams of a flow coalesced into one buffer (UDP_GRO, Linux 5.0)
+func EnableGRO(conn *net.UDPConn) bool {
+	return control(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_GRO, 1)
+	})
+}
+
+func control(conn *net.UDPConn, f func(fd int) error) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var ferr error
+	if err := raw.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return false
+	}
+
+	return ferr == nil
+}
+
+// SegmentOOB puts into oob the control message splitting a sent buffer into datagrams of size bytes, the last
+// one may be shorter. oob is reused when it has room.
+func SegmentOOB(oob []byte, size int) []byte {
+	if cap(oob) < unix.CmsgSpace(2) {
+		oob = make([]byte, unix.CmsgSpace(2))
+	}
+	oob = oob[:unix.CmsgSpace(2)]
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = unix.SOL_UDP
+	header.Type = unix.UDP_SEGMENT
+	header.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+	return oob
+}
+
+// GROOOBSize is the room a read needs for the control message of a coalesced buffer
+func GROOOBSize() int {
+	return unix.CmsgSpace(4)
+}
+
+// SegmentSize reads the size of the datagrams a coalesced buffer holds, 0 if the buffer is one datagram
+func SegmentSize(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, m := range messages {
+		if m.Header.Level == unix.SOL_UDP && m.Header.Type == unix.UDP_GRO && len(m.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+
+	return 0
+}
+
+// IsOffloadError tells whether a send failed because segmentation is not possible on the way out,
+// e.g. the device has no checksum offload. The caller should stop using GSO and send again without it.
+func IsOffloadError(err error) bool {
+	return errors.Is(err, unix.EIO) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOPROTOOPT)
+}
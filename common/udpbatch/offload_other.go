@@ -0,0 +1,33 @@
+//go:build !linux
+
+package udpbatch
+
+import (
+	"net"
+)
+
+// UDP segmentation and coalescing offload are Linux only
+
+func EnableGSO(conn *net.UDPConn) bool {
+	return false
+}
+
+func EnableGRO(conn *net.UDPConn) bool {
+	return false
+}
+
+func SegmentOOB(oob []byte, size int) []byte {
+	return nil
+}
+
+func GROOOBSize() int {
+	return 0
+}
+
+func SegmentSize(oob []byte) int {
+	return 0
+}
+
+func IsOffloadError(err error) bool {
+	return false
+}
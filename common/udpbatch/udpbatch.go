@@ -0,0 +1,30 @@
+package udpbatch
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// Message is one datagram of a batch, the same type for IPv4 and IPv6
+type Message = ipv4.Message
+
+// Conn reads and writes many datagrams with one system call, recvmmsg and sendmmsg on Linux
+type Conn interface {
+	ReadBatch(ms []Message, flags int) (int, error)
+	WriteBatch(ms []Message, flags int) (int, error)
+}
+
+// New wraps a UDP connection for batch I/O, or returns nil where the system has no batch calls and
+// the caller should stay on the one datagram per call path
+func New(conn *net.UDPConn) Conn {
+	if !supported {
+		return nil
+	}
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+
+	return ipv4.NewPacketConn(conn)
+}
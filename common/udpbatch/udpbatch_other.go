@@ -0,0 +1,6 @@
+//go:build !linux
+
+package udpbatch
+
+// the batch calls of x/net only move one datagram per call here
+const supported = false
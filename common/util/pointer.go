@@ -5,7 +5,7 @@ func BoolPtr(val bool) *bool {
 }
 
 
-func Uint32Ptr(val uint32) *uint32 {
+func Uint64Ptr(val uint64) *uint64 {
 	copy := val
 	return &copy
 }
\ No newline at end of file
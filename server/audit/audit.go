@@ -0,0 +1,243 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Events of the audit log
+const (
+	EventStart   = "start"   // a session began, with the request of the user
+	EventFile    = "file"    // a file of a transfer, once the session ended
+	EventEnd     = "end"     // a session ended
+	EventRefused = "refused" // a connection failed to authenticate
+)
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Session     string    `json:"session,omitempty"` // ties the entries of one session together
+	User        string    `json:"user,omitempty"`    // authenticated identity, empty when the server lets anybody in
+	Remote      string    `json:"remote,omitempty"`
+	Op          string    `json:"op,omitempty"`
+	Paths       []string  `json:"paths,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Digest      string    `json:"sha256,omitempty"`
+	Duration    float64   `json:"duration,omitempty"` // seconds
+	Outcome     string    `json:"outcome,omitempty"`  // "ok" or what went wrong
+	Retransmits int64     `json:"retransmittedBytes,omitempty"`
+	Previous    string    `json:"previous,omitempty"` // MAC the first entry of a file chains with, to check a file alone
+	MAC         string    `json:"mac,omitempty"`      // HMAC-SHA256 of the entry chained with the MAC of the one before
+}
+
+// Log appends entries as JSON lines to a file, and rotates it once it grows too big. With a key every entry is
+// signed together with the one before, so removing, changing or reordering entries breaks the chain.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64  // rotate once the file is that big, 0 never
+	keep    int    // rotated files kept: path.1 is the newest
+	key     []byte // nil leaves entries unsigned
+	last    string // MAC of the entry written last
+}
+
+// Open appends to the log at path, carrying on the chain of the entries already there
+func Open(path string, maxSize int64, keep int, key []byte) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, keep: keep, key: key}
+	if key != nil {
+		last, err := lastMAC(path)
+		if err != nil {
+			return nil, err
+		}
+		l.last = last
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Write appends the entry, stamped with the time if it has none. A nil log writes nothing.
+func (l *Log) Write(e Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Previous, e.MAC = "", ""
+	line, err := l.marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// a file starting mid-chain tells where it carries on from, once the files before it are rotated away
+	if l.key != nil && l.size == 0 && l.last != "" {
+		e.Previous = l.last
+		if line, err = l.marshal(&e); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if l.key != nil {
+		l.last = e.MAC
+	}
+	return err
+}
+
+// marshal makes the line of an entry, signed when the log has a key
+func (l *Log) marshal(e *Entry) ([]byte, error) {
+	if l.key != nil {
+		e.MAC = ""
+		e.MAC = sign(l.key, l.last, *e)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(line, '\n'), nil
+}
+
+// rotate moves path.i to path.i+1, dropping the oldest, and the current file to path.1
+func (l *Log) rotate() error {
+	l.file.Close()
+	os.Remove(l.path + "." + strconv.Itoa(l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+
+	if l.keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// sign is the MAC of an entry whose MAC field is empty, chained with the MAC of the entry before
+func sign(key []byte, previous string, e Entry) string {
+	line, _ := json.Marshal(e)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(previous))
+	h.Write(line)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks the chain of the entries read from r, starting after the entry whose MAC is previous, and returns
+// the MAC of the last entry to check the next file with. With no previous the chain starts where the first entry
+// says it does, the very first log ever written or the oldest one left after rotation.
+func Verify(r io.Reader, key []byte, previous string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if line == 1 && previous == "" {
+			previous = e.Previous
+		}
+
+		mac := e.MAC
+		e.MAC = ""
+		if !hmac.Equal([]byte(mac), []byte(sign(key, previous, e))) {
+			return "", fmt.Errorf("line %d: the entry or the one before was tampered with", line)
+		}
+		previous = mac
+	}
+
+	return previous, scanner.Err()
+}
+
+// lastMAC is the MAC of the last entry of the log at path, or of the file rotated last when it has none
+func lastMAC(path string) (string, error) {
+	last, err := lastMACOf(path)
+	if err == nil && last == "" {
+		last, err = lastMACOf(path + ".1")
+	}
+
+	return last, err
+}
+
+func lastMACOf(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	last := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			last = e.MAC
+		}
+	}
+
+	return last, scanner.Err()
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// tokenPrefix marks the hash of an API token in the user file, any other hash is a bcrypt one of a password
+const tokenPrefix = "sha256:"
+
+// validName keeps identity names usable as a directory name
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// dummyHash is compared against for unknown users, so they take as long as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("safe-udp"), bcrypt.DefaultCost)
+
+var ErrDenied = errors.New("authentication failed")
+
+// Identity is who a client authenticated as
+type Identity struct {
+	Name string
+}
+
+// Store knows the users of the server, read from a file of "name:hash" lines. The hash is a bcrypt one of a
+// password, or "sha256:" and the hex SHA-256 of an API token. A user may have several lines.
+type Store struct {
+	passwords map[string][][]byte
+	tokens    map[string]string // user by the hash of its token
+}
+
+// Load reads a user file, empty lines and lines starting with # are skipped
+func Load(name string) (*Store, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s := &Store{passwords: make(map[string][][]byte), tokens: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || !validName.MatchString(user) || hash == "" {
+			return nil, fmt.Errorf("%s:%d: expect name:hash", name, line)
+		}
+
+		if strings.HasPrefix(hash, tokenPrefix) {
+			s.tokens[strings.ToLower(strings.TrimPrefix(hash, tokenPrefix))] = user
+			continue
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		s.passwords[user] = append(s.passwords[user], []byte(hash))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Authenticate tells who the request comes from, by its API token or its user and password
+func (s *Store) Authenticate(request *model.Request) (*Identity, error) {
+	if request.APIToken != "" {
+		if user, ok := s.tokens[hashToken(request.APIToken)]; ok {
+			return &Identity{Name: user}, nil
+		}
+
+		return nil, ErrDenied
+	}
+
+	if request.User == "" {
+		return nil, errors.New("authentication required")
+	}
+
+	hashes, ok := s.passwords[request.User]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(request.Password))
+		return nil, ErrDenied
+	}
+
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(request.Password)) == nil {
+			return &Identity{Name: request.User}, nil
+		}
+	}
+
+	return nil, ErrDenied
+}
+
+// HashPassword makes the line of a user file letting the user in with the password
+func HashPassword(user string, password string) (string, error) {
+	if !validName.MatchString(user) {
+		return "", fmt.Errorf("invalid user name %q", user)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return user + ":" + string(hash), nil
+}
+
+// NewToken makes an API token for the user, and the line of a user file letting the token in
+func NewToken(user string) (string, string, error) {
+	if !validName.MatchString(user) {
+		return "", "", fmt.Errorf("invalid user name %q", user)
+	}
+
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", "", err
+	}
+
+	token := hex.EncodeToString(buffer)
+	return token, user + ":" + tokenPrefix + hashToken(token), nil
+}
+
+// hashToken is enough for API tokens, unlike passwords they are random and long
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
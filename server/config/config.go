@@ -0,0 +1,214 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/consts"
+	"github.com/gtxistxgao/safe-udp/common/cookie"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server configuration, set from the command line
+type Config struct {
+	Listen           string                        // address the control channel listens on, empty for every interface
+	Port             string                        // TCP port of the control channel
+	Root             string                        // directory the files of the clients are stored in, clients cannot reach outside of it
+	ConflictPolicies []fileoperator.ConflictPolicy // what clients may ask for when an uploaded file already exists
+	Compress         bool                          // compress downloads for clients asking for it
+	KeepOwner        bool                          // uploads kept with their metadata keep their owner, when running as root
+	OwnerUids        []int                         // owners uploads may keep besides the local account of their user
+	OwnerGids        []int                         // groups uploads may keep besides the one of the local account of their user
+	Read             fileoperator.ReadOptions      // how the files clients download are read
+	MaxSockets       int                           // UDP sockets a session may stripe its chunks over
+	Workers          int                           // go routines decoding the chunks of an upload, 0 runs one per CPU
+	ResumeGrace      time.Duration                 // how long a transfer waits for its client to come back, 0 disables resuming
+	ProofBits        int                           // leading zero bits of the proof of work a client solves before its request is read
+	ConnRate         float64                       // connections a host may open a minute
+	ConnBurst        int                           // connections a host may open at once after being quiet
+	MaxPending       int                           // connections of a host waiting for the server at once
+	Users            string                        // file of the users allowed in, empty lets anybody in without authentication
+	Policy           string                        // file of what every user may do where, empty keeps each user to a directory of its own
+	Quota            int64                         // bytes a user may store, 0 is no limit
+	GlobalQuota      int64                         // bytes all users may store together, 0 is no limit
+	Reserve          int64                         // bytes of free disk space uploads leave
+	Audit            string                        // file of the audit log, empty for none
+	AuditMaxSize     int64                         // rotate the audit log once it is that big, 0 never
+	AuditKeep        int                           // rotated audit logs kept
+	AuditKey         string                        // file of the key signing the audit log entries, empty leaves them unsigned
+}
+
+// Parse reads the configuration from the command line arguments
+func Parse(args []string) (*Config, error) {
+	cfg := &Config{}
+	var policies string
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Listen, "listen", "localhost", "address to listen to for control connections, empty for every interface; clients on other hosts need one they reach")
+	fs.StringVar(&cfg.Port, "port", "8888", "TCP port to listen to for control connections")
+	fs.StringVar(&cfg.Root, "root", ".", "storage root directory")
+	fs.StringVar(&policies, "conflict-policies", "fail,overwrite,rename,version", "comma separated conflict policies clients may use")
+	fs.BoolVar(&cfg.Compress, "compress", true, "compress downloads for clients asking for it, uploads are always accepted compressed")
+	fs.BoolVar(&cfg.KeepOwner, "keep-owner", false, "uploads with --preserve keep their owner when the server runs as root, if it is the local account named like the user or in -owner-uids and -owner-gids")
+	fs.Var((*ids)(&cfg.OwnerUids), "owner-uids", "comma separated uids uploads may keep with -keep-owner")
+	fs.Var((*ids)(&cfg.OwnerGids), "owner-gids", "comma separated gids uploads may keep with -keep-owner")
+	readAhead := fs.Int("read-ahead", fileoperator.DefaultReadOptions.Window>>10, "KiB read from a file at once for downloads, the windows read last are kept for resends")
+	fs.IntVar(&cfg.Read.CacheBlocks, "read-cache", fileoperator.DefaultReadOptions.CacheBlocks, "read-ahead windows kept in memory per download for resends")
+	fs.BoolVar(&cfg.Read.Mmap, "mmap", false, "map the files clients download instead of reading them")
+	fs.IntVar(&cfg.MaxSockets, "max-sockets", 8, "UDP sockets a session may stripe its chunks over")
+	fs.IntVar(&cfg.Workers, "decode-workers", consts.RawDataWorkerNumber, "go routines decoding the chunks of an upload, 0 runs one per CPU")
+	fs.StringVar(&cfg.Users, "users", "", "file of name:hash lines of the users allowed in, each stores under a directory of its own in the root; empty lets anybody in")
+	fs.StringVar(&cfg.Policy, "policy", "", "file of the paths every user or group may read, write, delete and list; the users then share the root, reloaded when it changes")
+	fs.Var((*size)(&cfg.Quota), "quota", "bytes each user may store, with a K, M, G or T suffix; 0 is no limit")
+	fs.Var((*size)(&cfg.GlobalQuota), "global-quota", "bytes all users may store together, with a K, M, G or T suffix; 0 is no limit")
+	cfg.Reserve = 1 << 30
+	fs.Var((*size)(&cfg.Reserve), "reserve", "free disk space uploads must leave, with a K, M, G or T suffix")
+	fs.StringVar(&cfg.Audit, "audit", "", "file to append the audit log of every session to, as JSON lines; empty for none")
+	cfg.AuditMaxSize = 100 << 20
+	fs.Var((*size)(&cfg.AuditMaxSize), "audit-max-size", "rotate the audit log once it is that big, with a K, M, G or T suffix; 0 never")
+	fs.IntVar(&cfg.AuditKeep, "audit-keep", 5, "rotated audit logs kept, as file.1 (newest) to file.N")
+	fs.StringVar(&cfg.AuditKey, "audit-key", "", "file of a secret key to sign the audit log entries with, chained so tampering shows")
+	fs.IntVar(&cfg.ProofBits, "pow-bits", 16, "leading zero bits of the proof of work a client solves before the server takes its request, 0 only checks the cookie")
+	fs.Float64Var(&cfg.ConnRate, "conn-rate", 60, "connections a host may open a minute")
+	fs.IntVar(&cfg.ConnBurst, "conn-burst", 20, "connections a host may open at once after being quiet")
+	fs.IntVar(&cfg.MaxPending, "max-pending", 8, "connections of a host waiting for the server at once")
+	fs.DurationVar(&cfg.ResumeGrace, "resume-grace", time.Minute, "how long a transfer waits for its client to come back on a new connection, 0 disables resuming")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *readAhead <= 0 || cfg.Read.CacheBlocks <= 0 {
+		err := fmt.Errorf("read-ahead and read-cache must be positive")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	cfg.Read.Window = *readAhead << 10
+
+	if cfg.ProofBits < 0 || cfg.ProofBits > cookie.MaxBits {
+		err := fmt.Errorf("pow-bits must be in [0, %d]", cookie.MaxBits)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.ConnRate <= 0 || cfg.ConnBurst <= 0 || cfg.MaxPending <= 0 {
+		err := fmt.Errorf("conn-rate, conn-burst and max-pending must be positive")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.Policy != "" && cfg.Users == "" {
+		err := fmt.Errorf("policy needs users to tell who is who")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.Users == "" && cfg.Quota > 0 {
+		err := fmt.Errorf("quota is per user directory, without users everybody shares the root: use global-quota")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.Policy != "" && cfg.Quota > 0 {
+		err := fmt.Errorf("quota is per user directory, with a policy the users share the root: use global-quota")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.AuditKeep < 0 {
+		err := fmt.Errorf("audit-keep must not be negative")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.ResumeGrace < 0 {
+		err := fmt.Errorf("resume-grace must not be negative")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.Workers < 0 {
+		err := fmt.Errorf("decode-workers must not be negative")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	if cfg.MaxSockets <= 0 || cfg.MaxSockets > consts.MaxSessionSockets {
+		err := fmt.Errorf("max-sockets must be in [1, %d]", consts.MaxSessionSockets)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+
+	for _, name := range strings.Split(policies, ",") {
+		policy, err := fileoperator.ParseConflictPolicy(strings.TrimSpace(name))
+		if err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		cfg.ConflictPolicies = append(cfg.ConflictPolicies, policy)
+	}
+
+	return cfg, nil
+}
+
+// AllowConflictPolicy tells whether clients may use the policy
+func (c *Config) AllowConflictPolicy(policy fileoperator.ConflictPolicy) bool {
+	for _, p := range c.ConflictPolicies {
+		if p == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// size is a byte count flag taking a binary K, M, G or T suffix
+type size int64
+
+func (s *size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *size) Set(raw string) error {
+	text := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(raw)), "B")
+	shift := 0
+	if i := strings.IndexAny(text, "KMGT"); i >= 0 && i == len(text)-1 {
+		shift = 10 * (strings.IndexByte("KMGT", text[i]) + 1)
+		text = text[:i]
+	}
+
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64>>shift {
+		return fmt.Errorf("invalid size %q", raw)
+	}
+
+	*s = size(value << shift)
+	return nil
+}
+
+// ids is a comma separated list of user or group ids
+type ids []int
+
+func (i *ids) String() string {
+	texts := make([]string, len(*i))
+	for n, id := range *i {
+		texts[n] = strconv.Itoa(id)
+	}
+
+	return strings.Join(texts, ",")
+}
+
+func (i *ids) Set(raw string) error {
+	*i = nil
+	for _, text := range strings.Split(raw, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil || id < 0 {
+			return fmt.Errorf("invalid id %q", text)
+		}
+		*i = append(*i, id)
+	}
+
+	return nil
+}
@@ -4,29 +4,85 @@ import (
 	"context"
 	"fmt"
 	"github.com/gtxistxgao/safe-udp/common/consts"
-	"github.com/gtxistxgao/safe-udp/common/util"
+	"github.com/gtxistxgao/safe-udp/common/cookie"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/server/audit"
+	"github.com/gtxistxgao/safe-udp/server/auth"
+	"github.com/gtxistxgao/safe-udp/server/config"
+	"github.com/gtxistxgao/safe-udp/server/limit"
+	"github.com/gtxistxgao/safe-udp/server/policy"
+	"github.com/gtxistxgao/safe-udp/server/session"
+	"github.com/gtxistxgao/safe-udp/server/storage"
 	"github.com/gtxistxgao/safe-udp/server/user"
 	"log"
 	"net"
+	"os"
+	"time"
 )
 
+// how long a new connection has to send its request
+const requestTimeout = 30 * time.Second
+
 type Controller struct {
 	ctx      context.Context
 	listener *net.TCPListener
 	userMap  map[string]*user.User
+	root     *storage.Root
+	cfg      *config.Config
+	services *user.Services
+	cookies  *cookie.Issuer // challenges a connection answers before we read its request
+	limiter  *limit.Limiter // connections of every host
+	users    *auth.Store    // nil lets anybody in
 }
 
-func New(ctx context.Context, port string) *Controller {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", "localhost:"+port)
+func New(ctx context.Context, cfg *config.Config) *Controller {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(cfg.Listen, cfg.Port))
 	checkError(err)
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	checkError(err)
 
+	root, err := storage.NewRoot(cfg.Root)
+	checkError(err)
+	log.Println("Storage root is", root.Dir())
+
+	cookies, err := cookie.NewIssuer(cfg.ProofBits, requestTimeout)
+	checkError(err)
+
+	var users *auth.Store
+	if cfg.Users != "" {
+		users, err = auth.Load(cfg.Users)
+		checkError(err)
+		log.Println("Users are authenticated with", cfg.Users)
+	}
+
+	var rights *policy.Watcher
+	if cfg.Policy != "" {
+		rights, err = policy.Watch(ctx, cfg.Policy)
+		checkError(err)
+		log.Println("Users share the storage root under the policy", cfg.Policy)
+	}
+
+	auditLog, err := openAudit(cfg)
+	checkError(err)
+
 	c := &Controller{
 		ctx:      ctx,
 		listener: listener,
 		userMap:  make(map[string]*user.User),
+		root:     root,
+		cfg:      cfg,
+		services: &user.Services{
+			Cfg:      cfg,
+			Sessions: session.NewRegistry(cfg.ResumeGrace),
+			Quota:    storage.NewQuota(root, cfg.Quota, cfg.GlobalQuota, cfg.Reserve),
+			Audit:    auditLog,
+			Policy:   rights,
+		},
+		cookies: cookies,
+		limiter: limit.New(cfg.ConnRate, cfg.ConnBurst, cfg.MaxPending),
+		users:   users,
 	}
 
 	return c
@@ -34,73 +90,172 @@ func New(ctx context.Context, port string) *Controller {
 
 func (c *Controller) Run() {
 	userChan := make(chan *user.User, consts.MaxUserLimit)
-	ready := make(chan *bool, consts.MaxUserLimit)
-
-	go c.userGreeter(ready, userChan)
-	go c.userManager(ready, userChan)
 
-	// Let's start!
-	for i := 0; i < consts.MaxUserLimit; i++ {
-		ready <- util.BoolPtr(true)
-	}
+	go c.userGreeter(userChan)
+	go c.userManager(userChan)
 
 	select {
 	case <-c.ctx.Done():
+		c.listener.Close()
 		fmt.Println("Controller cancelled")
 	}
 }
 
-func (c *Controller) userGreeter(ready chan *bool, userChan chan *user.User) {
+// userGreeter accepts every connection right away, so a client resuming its session is not queued behind the
+// session itself
+func (c *Controller) userGreeter(userChan chan *user.User) {
 	for {
-		signal := <-ready
-		if signal == nil {
-			break
-		}
-
 		conn, err := c.listener.Accept()
 		if err != nil {
+			if c.ctx.Err() != nil {
+				fmt.Println("userGreeter cancelled")
+				return
+			}
+
 			log.Printf("error: %s", err)
 			continue
 		}
 
-		newUser := user.New(conn)
-		log.Println("New user joined")
-		c.userMap[conn.RemoteAddr().String()] = newUser
-		userChan <- newUser
+		// refused before anything is spent on the connection
+		host := hostOf(conn)
+		if err := c.limiter.Admit(host); err != nil {
+			log.Println("Refuse connection:", err)
+			conn.Write([]byte(consts.Error + err.Error() + "\n"))
+			conn.Close()
+			continue
+		}
+
+		go c.greet(conn, host, userChan)
+	}
+}
+
+// greet reads the request of a new connection once it answered our challenge: a resumed session goes on at once,
+// a new user waits for its turn
+func (c *Controller) greet(conn net.Conn, host string, userChan chan *user.User) {
+	defer c.limiter.Done(host)
+
+	tcpConn := tcpconn.New(conn)
+	request, err := c.challenge(conn, tcpConn, host)
+	if err != nil {
+		log.Printf("Refuse connection from %s: %s\n", host, err)
+		tcpConn.SendError(err)
+		tcpConn.Close()
+		return
 	}
 
+	// a client resuming its session authenticates again, the session token alone does not let it in
+	identity, root, err := c.authenticate(request)
+	if err != nil {
+		log.Printf("Refuse user %q from %s: %s\n", request.User, host, err)
+		c.services.Audit.Write(audit.Entry{Event: audit.EventRefused, User: request.User, Remote: tcpConn.RemoteAddr(), Op: request.Op, Outcome: err.Error()})
+		tcpConn.SendError(err)
+		tcpConn.Close()
+		return
+	}
+
+	if request.Op == consts.OpResume {
+		if err := c.services.Sessions.Resume(tcpConn, request, identity); err != nil {
+			log.Println("Fail to resume the session: ", err)
+		}
+		return
+	}
+
+	log.Println("New user joined")
 	select {
+	case userChan <- user.New(tcpConn, request, identity, root, c.services):
 	case <-c.ctx.Done():
-		for len(ready) > 0 {
-			<-ready
-		}
+		tcpConn.Close()
+	}
+}
+
+// authenticate tells who sent the request and the storage root of that user. Without a user store everybody is
+// anonymous and shares the root, with a policy the users share it too and the policy tells who may do what.
+func (c *Controller) authenticate(request *model.Request) (*auth.Identity, *storage.Root, error) {
+	if c.users == nil {
+		return nil, c.root, nil
+	}
+
+	identity, err := c.users.Authenticate(request)
+	request.Password, request.APIToken = "", "" // not needed any more
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.services.Policy != nil {
+		return identity, c.root, nil
+	}
+
+	root, err := c.root.Sub(identity.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identity, root, nil
+}
+
+// challenge greets the connection with a challenge, and reads the request that comes with the answer
+func (c *Controller) challenge(conn net.Conn, tcpConn *tcpconn.TcpConn, host string) (*model.Request, error) {
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	defer conn.SetDeadline(time.Time{})
 
-		ready <- nil
-		fmt.Println("userGreeter cancelled")
+	if err := tcpConn.SendChallenge(c.cookies.Issue(host)); err != nil {
+		return nil, err
 	}
+
+	request, err := tcpConn.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.cookies.Verify(host, request.Proof); err != nil {
+		return nil, err
+	}
+
+	return request, nil
 }
 
-func (c *Controller) userManager(ready chan *bool, userChan chan *user.User) {
+// userManager serves the users one after the other
+func (c *Controller) userManager(userChan chan *user.User) {
 	for {
-		newUser := <-userChan
-		if newUser == nil {
-			break
+		select {
+		case <-c.ctx.Done():
+			fmt.Println("userManager cancelled")
+			return
+		case newUser := <-userChan:
+			log.Println("User started")
+			c.userMap[newUser.Info()] = newUser
+			newUser.Start()
+			delete(c.userMap, newUser.Info())
 		}
+	}
+}
 
-		log.Println("User started")
-		newUser.Start()
-		ready <- util.BoolPtr(true)
+// openAudit opens the audit log of the configuration, nil when there is none
+func openAudit(cfg *config.Config) (*audit.Log, error) {
+	if cfg.Audit == "" {
+		return nil, nil
 	}
 
-	select {
-	case <-c.ctx.Done():
-		for len(ready) > 0 {
-			<-ready
+	var key []byte
+	if cfg.AuditKey != "" {
+		var err error
+		if key, err = os.ReadFile(cfg.AuditKey); err != nil {
+			return nil, err
 		}
+	}
 
-		ready <- nil
-		fmt.Println("userManager cancelled")
+	log.Println("Audit log is", cfg.Audit)
+	return audit.Open(cfg.Audit, cfg.AuditMaxSize, cfg.AuditKeep, key)
+}
+
+// hostOf is the IP address a connection comes from
+func hostOf(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
 	}
+
+	return host
 }
 
 func checkError(err error) {
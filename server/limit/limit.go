@@ -0,0 +1,100 @@
+package limit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how often hosts that are back to a full bucket and have no connection are forgotten
+const sweepInterval = time.Minute
+
+// Limiter keeps one host from taking the server for itself: every host gets a bucket of connections refilled at a
+// steady rate, and may only have so many connections waiting for the server at once
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64 // connections a host gets back per second
+	burst     float64 // connections a host may open at once after being quiet
+	maxActive int     // connections of a host waiting for the server at once
+	hosts     map[string]*host
+	swept     time.Time
+}
+
+type host struct {
+	tokens float64
+	last   time.Time // when the tokens were counted
+	active int
+}
+
+// New makes a limiter allowing a host perMinute connections a minute, burst at once and maxActive waiting
+func New(perMinute float64, burst int, maxActive int) *Limiter {
+	return &Limiter{
+		rate:      perMinute / 60,
+		burst:     float64(burst),
+		maxActive: maxActive,
+		hosts:     make(map[string]*host),
+		swept:     time.Now(),
+	}
+}
+
+// Admit takes a connection of the host into account, or tells why it is refused. An admitted connection is
+// given back with Done.
+func (l *Limiter) Admit(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{tokens: l.burst, last: now}
+		l.hosts[name] = h
+	}
+	l.refill(h, now)
+
+	if h.active >= l.maxActive {
+		return fmt.Errorf("too many connections from %s", name)
+	}
+
+	if h.tokens < 1 {
+		return fmt.Errorf("too many connections from %s lately, retry later", name)
+	}
+
+	h.tokens--
+	h.active++
+	return nil
+}
+
+// Done gives back a connection of the host taken by Admit
+func (l *Limiter) Done(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.hosts[name]; ok && h.active > 0 {
+		h.active--
+	}
+}
+
+func (l *Limiter) refill(h *host, now time.Time) {
+	h.tokens += now.Sub(h.last).Seconds() * l.rate
+	if h.tokens > l.burst {
+		h.tokens = l.burst
+	}
+	h.last = now
+}
+
+// sweep forgets the hosts that would start over from a new bucket anyway, so the map does not grow for ever
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+
+	for name, h := range l.hosts {
+		l.refill(h, now)
+		if h.active == 0 && h.tokens >= l.burst {
+			delete(l.hosts, name)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the policy file is checked for changes
+const reloadInterval = 5 * time.Second
+
+// userVar in a path prefix stands for the name of the user the rule is checked for
+const userVar = "{user}"
+
+// validName keeps group names to what user names are made of
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Permission is what a user may do under a path, a set of the permissions below
+type Permission uint8
+
+const (
+	Read   Permission = 1 << iota // download files
+	Write                         // upload files and make directories
+	Delete                        // remove files and directories, and overwrite files on upload
+	List                          // list directories and stat files
+)
+
+var letters = []struct {
+	letter     byte
+	permission Permission
+	name       string
+}{
+	{'r', Read, "read"},
+	{'w', Write, "write"},
+	{'d', Delete, "delete"},
+	{'l', List, "list"},
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, l := range letters {
+		if p&l.permission != 0 {
+			names = append(names, l.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// parsePermission reads permissions like "rwdl", "-" for none
+func parsePermission(text string) (Permission, error) {
+	var p Permission
+	for i := 0; i < len(text); i++ {
+		if text[i] == '-' {
+			continue
+		}
+
+		found := false
+		for _, l := range letters {
+			if text[i] == l.letter {
+				p, found = p|l.permission, true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown permission %q, expect letters of rwdl", text[i])
+		}
+	}
+
+	return p, nil
+}
+
+// Policy tells what every user may do where in the storage root. It is read from a file of lines:
+//
+//	group <name> <user>...
+//	allow <user|@group|*> <rwdl> <path prefix>
+//
+// A user may do what any rule matching it allows under the prefix, and nothing else.
+type Policy struct {
+	groups map[string][]string // groups of every user
+	rules  []rule
+}
+
+type rule struct {
+	subject    string // a user, "@" and a group, or "*" for everybody
+	permission Permission
+	prefix     string // slash separated and clean, "." is the whole root
+}
+
+// Load reads a policy file, empty lines and lines starting with # are skipped
+func Load(name string) (*Policy, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Parse(file, name)
+}
+
+// Parse reads a policy, name tells where it comes from in errors
+func Parse(r io.Reader, name string) (*Policy, error) {
+	p := &Policy{groups: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if err := p.parseLine(fields); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Policy) parseLine(fields []string) error {
+	switch fields[0] {
+	case "group":
+		if len(fields) < 2 || !validName.MatchString(fields[1]) {
+			return fmt.Errorf("expect group <name> <user>...")
+		}
+
+		for _, member := range fields[2:] {
+			if !validName.MatchString(member) {
+				return fmt.Errorf("invalid user name %q", member)
+			}
+			p.groups[member] = append(p.groups[member], fields[1])
+		}
+	case "allow":
+		if len(fields) != 4 {
+			return fmt.Errorf("expect allow <user|@group|*> <rwdl> <path prefix>")
+		}
+
+		subject := fields[1]
+		if subject != "*" && !validName.MatchString(strings.TrimPrefix(subject, "@")) {
+			return fmt.Errorf("invalid user or group %q", subject)
+		}
+
+		permission, err := parsePermission(fields[2])
+		if err != nil {
+			return err
+		}
+
+		p.rules = append(p.rules, rule{subject: subject, permission: permission, prefix: clean(fields[3])})
+	default:
+		return fmt.Errorf("unknown directive %q, expect group or allow", fields[0])
+	}
+
+	return nil
+}
+
+// Allowed is what the user may do with the slash separated path, relative to the storage root
+func (p *Policy) Allowed(user string, name string) Permission {
+	name = clean(name)
+
+	var allowed Permission
+	for _, r := range p.rules {
+		if p.matches(r.subject, user) && under(name, strings.ReplaceAll(r.prefix, userVar, user)) {
+			allowed |= r.permission
+		}
+	}
+
+	return allowed
+}
+
+// Check tells why the user may not do everything of permission with the path
+func (p *Policy) Check(user string, permission Permission, name string) error {
+	if missing := permission &^ p.Allowed(user, name); missing != 0 {
+		return fmt.Errorf("%s: %s permission denied", clean(name), missing)
+	}
+
+	return nil
+}
+
+func (p *Policy) matches(subject string, user string) bool {
+	if subject == "*" || subject == user {
+		return true
+	}
+
+	if group, ok := strings.CutPrefix(subject, "@"); ok {
+		for _, g := range p.groups[user] {
+			if g == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// clean makes a path asked by a client or a prefix of the policy comparable, "." being the root
+func clean(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+// under tells whether the path is the prefix or inside it, a prefix only covers whole path elements
+func under(name string, prefix string) bool {
+	return prefix == "." || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// Watcher holds the policy of a file and reloads it when the file changes, a policy that fails to load leaves the
+// one before in place
+type Watcher struct {
+	mu       sync.RWMutex
+	file     string
+	policy   *Policy
+	modified time.Time // of the file the policy was read from
+	size     int64
+}
+
+// Watch loads the policy file and reloads it on changes until the context is done
+func Watch(ctx context.Context, file string) (*Watcher, error) {
+	w := &Watcher{file: file}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := w.reload(); err != nil {
+					log.Println("Keep the policy before, fail to reload it:", err)
+				}
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// reload reads the policy file again if it changed since it was read last
+func (w *Watcher) reload() error {
+	info, err := os.Stat(w.file)
+	if err != nil {
+		return err
+	}
+
+	w.mu.RLock()
+	unchanged := w.policy != nil && info.ModTime().Equal(w.modified) && info.Size() == w.size
+	w.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	policy, err := Load(w.file)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if w.policy != nil {
+			w.modified, w.size = info.ModTime(), info.Size() // told once, until the file changes again
+		}
+		return err
+	}
+
+	reloaded := w.policy != nil
+	w.policy, w.modified, w.size = policy, info.ModTime(), info.Size()
+	if reloaded {
+		log.Println("Reloaded the policy", w.file)
+	}
+	return nil
+}
+
+// Check tells why the user may not do everything of permission with the path. A nil watcher allows everything.
+func (w *Watcher) Check(user string, permission Permission, name string) error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.RLock()
+	policy := w.policy
+	w.mu.RUnlock()
+	return policy.Check(user, permission, name)
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+# staff share the shared directory, everybody reads public
+group staff alice bob
+group admins carol
+
+allow @staff rwl shared
+allow alice d shared/alice
+allow * rl public
+allow * rwdl home/{user}
+allow @admins rwdl /
+allow dave - shared
+`
+
+func TestCheck(t *testing.T) {
+	p, err := Parse(strings.NewReader(testPolicy), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user       string
+		permission Permission
+		name       string
+		allowed    bool
+	}{
+		{"alice", Read | Write | List, "shared", true},
+		{"alice", Write, "shared/docs/a.txt", true},
+		{"alice", Delete, "shared/docs/a.txt", false},
+		{"alice", Delete, "shared/alice/a.txt", true},
+		{"bob", Delete, "shared/alice/a.txt", false},
+		{"bob", Write, "shared/./docs/../b.txt", true},
+		{"bob", Write, "sharedx/b.txt", false},
+		{"bob", Write, "../shared/b.txt", true}, // cleaned to shared/b.txt, the root does not go higher
+		{"bob", Write, "/shared/b.txt", true},
+		{"eve", Read, "shared/a.txt", false},
+		{"eve", Read | List, "public/a.txt", true},
+		{"eve", Write, "public/a.txt", false},
+		{"eve", Read | Write | Delete | List, "home/eve/a.txt", true},
+		{"eve", Read, "home/alice/a.txt", false},
+		{"eve", Read, "home/eve2/a.txt", false},
+		{"eve", List, ".", false},
+		{"carol", Delete, "anything/at/all", true},
+		{"carol", List, "", true},
+		{"dave", Read, "shared/a.txt", false},
+		{"staff", Read, "shared/a.txt", false},
+	}
+	for _, test := range tests {
+		err := p.Check(test.user, test.permission, test.name)
+		if test.allowed && err != nil {
+			t.Errorf("%s %s %s: %s", test.user, test.permission, test.name, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s %s %s: allowed, want denied", test.user, test.permission, test.name)
+		}
+	}
+}
+
+func TestCheckTellsMissing(t *testing.T) {
+	p, err := Parse(strings.NewReader("allow alice rl docs"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Check("alice", Read|Write|Delete, "docs/../docs/a.txt")
+	if err == nil || err.Error() != "docs/a.txt: write,delete permission denied" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // part of the error, empty for a valid line
+	}{
+		{"allow alice rwdl docs", ""},
+		{"allow alice - docs", ""},
+		{"  # comment", ""},
+		{"group staff", ""},
+		{"allow alice rwx docs", "unknown permission"},
+		{"allow alice rw", "expect allow"},
+		{"allow alice rw docs more", "expect allow"},
+		{"allow al/ice rw docs", "invalid user"},
+		{"allow @ rw docs", "invalid user"},
+		{"group", "expect group"},
+		{"group st@ff alice", "expect group"},
+		{"group staff al*ce", "invalid user"},
+		{"deny alice r docs", "unknown directive"},
+	}
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader("\n"+test.line), "test")
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%q: %s", test.line, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%q: got %v, want an error about %s", test.line, err, test.want)
+		case err != nil && !strings.HasPrefix(err.Error(), "test:2: "):
+			t.Errorf("%q: %s does not tell the line", test.line, err)
+		}
+	}
+}
+
+func TestNilWatcherAllows(t *testing.T) {
+	var w *Watcher
+	if err := w.Check("anybody", Read|Write|Delete|List, "anywhere"); err != nil {
+		t.Error(err)
+	}
+}
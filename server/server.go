@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"github.com/gtxistxgao/safe-udp/server/config"
 	"github.com/gtxistxgao/safe-udp/server/controller"
 	"log"
+	"os"
+	"strings"
 )
 
 /*
@@ -34,7 +38,18 @@ func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	defer cancel()
 
-	c := controller.New(ctx, "8888")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(tool(os.Args[1], os.Args[2:]))
+	}
+
+	cfg, err := config.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	c := controller.New(ctx, cfg)
 	go c.Run()
 
 	select {
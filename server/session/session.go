@@ -0,0 +1,152 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/server/auth"
+	"log"
+	"sync"
+	"time"
+)
+
+// Session is a transfer a client may carry on from a new control connection, e.g. after its address changed.
+// It is known by an id that has nothing to do with the addresses, and resuming it takes the token that came with it
+// and the credentials of the user who opened it.
+type Session struct {
+	ID      string
+	token   string
+	owner   string // name of the user who opened the session, empty when the server lets anybody in
+	conn    *tcpconn.TcpConn
+	over    bool
+	outcome error
+}
+
+// Registry knows the sessions running, and for the grace period the outcome of the ones that ended, so a client
+// that lost the last message still learns how its transfer went
+type Registry struct {
+	mu       sync.Mutex
+	grace    time.Duration
+	sessions map[string]*Session
+}
+
+// NewRegistry makes a registry whose sessions wait grace for their client to come back, 0 disables resuming
+func NewRegistry(grace time.Duration) *Registry {
+	return &Registry{
+		grace:    grace,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Enabled tells whether sessions can be resumed at all
+func (r *Registry) Enabled() bool {
+	return r.grace > 0
+}
+
+// Open registers the session the user runs on conn and tells the client how to resume it, if resuming is enabled.
+// From now on a broken connection waits for the client to come back.
+func (r *Registry) Open(conn *tcpconn.TcpConn, identity *auth.Identity) (*Session, error) {
+	if !r.Enabled() {
+		// an empty session tells the client it cannot resume
+		return nil, conn.SendSession("", "")
+	}
+
+	id, err := random(16)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := random(32)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{ID: id, token: token, owner: nameOf(identity), conn: conn}
+	r.mu.Lock()
+	r.sessions[id] = s
+	r.mu.Unlock()
+
+	conn.WaitForResume(r.grace)
+	log.Println("Session", id, "opened")
+	return s, conn.SendSession(id, token)
+}
+
+// Close records how the session ended, a client resuming it during the grace period is told
+func (r *Registry) Close(s *Session, outcome error) {
+	if s == nil {
+		return
+	}
+
+	r.mu.Lock()
+	s.over = true
+	s.outcome = outcome
+	r.mu.Unlock()
+
+	time.AfterFunc(r.grace, func() {
+		r.mu.Lock()
+		delete(r.sessions, s.ID)
+		r.mu.Unlock()
+	})
+}
+
+// Resume carries on the session the request names on the connection of next, once the token matches and the
+// request authenticated as the user who opened the session
+func (r *Registry) Resume(next *tcpconn.TcpConn, request *model.Request, identity *auth.Identity) error {
+	r.mu.Lock()
+	s, ok := r.sessions[request.Session]
+	if ok && (subtle.ConstantTimeCompare([]byte(s.token), []byte(request.Token)) != 1 || s.owner != nameOf(identity)) {
+		ok = false
+	}
+
+	over, outcome := ok && s.over, error(nil)
+	if ok {
+		outcome = s.outcome
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		err := errors.New("unknown session or wrong token")
+		next.SendError(err)
+		next.Close()
+		return err
+	}
+
+	if over {
+		if outcome != nil {
+			next.SendError(outcome)
+		} else {
+			next.SendFinishSignal()
+		}
+		next.Close()
+		return nil
+	}
+
+	if err := next.SendResumed(); err != nil {
+		next.Close()
+		return err
+	}
+
+	log.Println("Session", s.ID, "resumed from", next.RemoteHost())
+	s.conn.Migrate(next)
+	return nil
+}
+
+func nameOf(identity *auth.Identity) string {
+	if identity == nil {
+		return ""
+	}
+
+	return identity.Name
+}
+
+func random(size int) (string, error) {
+	buffer := make([]byte, size)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageRefresh is how long the usage of a directory is trusted before it is walked again, in the background, to
+// catch what changed behind the server's back
+const usageRefresh = 5 * time.Minute
+
+// errUnknownSpace tells the free space of a file system cannot be learnt on this system
+var errUnknownSpace = errors.New("free space unknown")
+
+// Quota decides whether an upload may be stored, before any of it is sent
+type Quota struct {
+	root    *Root // the storage root of the server, every user included
+	perUser int64 // bytes a user may store, 0 is no limit
+	global  int64 // bytes all users may store together, 0 is no limit
+	reserve int64 // bytes of free space the file system keeps after the upload
+
+	mu     sync.Mutex
+	usages map[string]*usage // by directory, walked once and kept up to date by Add
+}
+
+// usage is what the files under a directory hold
+type usage struct {
+	bytes   int64
+	walked  time.Time
+	walking bool // a walk in the background is on its way
+}
+
+func NewQuota(root *Root, perUser int64, global int64, reserve int64) *Quota {
+	return &Quota{root: root, perUser: perUser, global: global, reserve: reserve, usages: make(map[string]*usage)}
+}
+
+// Admit tells why an upload of size bytes, dataSize of them not holes, cannot be stored under userRoot. The user
+// quota only applies when the user has a root of its own, files the upload overwrites still count.
+func (q *Quota) Admit(userRoot *Root, size int64, dataSize int64) error {
+	if q.perUser > 0 && userRoot != q.root {
+		used, err := q.used(userRoot.Dir())
+		if err != nil {
+			return err
+		}
+
+		if used+size > q.perUser {
+			return fmt.Errorf("quota exceeded: %s stored of %s, the upload needs %s more",
+				FormatSize(used), FormatSize(q.perUser), FormatSize(size))
+		}
+	}
+
+	if q.global > 0 {
+		used, err := q.used(q.root.Dir())
+		if err != nil {
+			return err
+		}
+
+		if used+size > q.global {
+			return fmt.Errorf("server quota exceeded: the upload needs %s, %s left", FormatSize(size), FormatSize(q.global-used))
+		}
+	}
+
+	free, err := freeSpace(userRoot.Dir())
+	if err == errUnknownSpace {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if dataSize+q.reserve > free {
+		return fmt.Errorf("not enough disk space on the server: the upload needs %s and %s must stay free, %s free",
+			FormatSize(dataSize), FormatSize(q.reserve), FormatSize(free))
+	}
+
+	return nil
+}
+
+// Add counts delta more bytes stored at localPath, for every directory whose usage we know that holds it.
+// Uploads add what they stored and removes take off what they removed, so admitting an upload walks no tree.
+func (q *Quota) Add(localPath string, delta int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for dir, u := range q.usages {
+		if within(dir, localPath) {
+			u.bytes += delta
+		}
+	}
+}
+
+// used is how many bytes the files under dir hold. Only the first time walks the tree before answering, later the
+// tree is walked again in the background once the usage is older than usageRefresh.
+func (q *Quota) used(dir string) (int64, error) {
+	q.mu.Lock()
+	if u, ok := q.usages[dir]; ok {
+		if !u.walking && time.Since(u.walked) > usageRefresh {
+			u.walking = true
+			go q.rewalk(dir, u)
+		}
+
+		bytes := u.bytes
+		q.mu.Unlock()
+		return bytes, nil
+	}
+	q.mu.Unlock()
+
+	bytes, err := Usage(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u, ok := q.usages[dir]; ok {
+		return u.bytes, nil
+	}
+
+	q.usages[dir] = &usage{bytes: bytes, walked: time.Now()}
+	return bytes, nil
+}
+
+// rewalk counts the usage of dir again. What is added meanwhile may be counted twice or not at all until the
+// next walk, a quota is no exact science.
+func (q *Quota) rewalk(dir string, u *usage) {
+	bytes, err := Usage(dir)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u.walking = false
+	u.walked = time.Now()
+	if err == nil {
+		u.bytes = bytes
+	}
+}
+
+// within tells whether localPath is dir or under it
+func within(dir string, localPath string) bool {
+	rel, err := filepath.Rel(dir, localPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Usage is how many bytes the files under dir hold
+func Usage(dir string) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			used += info.Size()
+		}
+
+		return nil
+	})
+
+	return used, err
+}
+
+// FormatSize writes a byte count the way people read it
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit && size > -unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value, prefix := float64(size)/unit, 0
+	for ; (value >= unit || value <= -unit) && prefix < 4; prefix++ {
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[prefix])
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the usage is walked once, then follows what the server tells it stored and removed
+func TestQuotaFollowsAdd(t *testing.T) {
+	root, err := NewRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := root.Sub("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(user.Dir(), "a"), make([]byte, 600), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQuota(root, 1000, 0, 0)
+	if err := q.Admit(user, 400, 0); err != nil {
+		t.Fatalf("400 bytes more fit in 1000 with 600 stored: %s", err)
+	}
+
+	if err := q.Admit(user, 401, 0); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("401 bytes more must not fit in 1000 with 600 stored, got %v", err)
+	}
+
+	// stored behind the server's back: not walked again
+	if err := os.WriteFile(filepath.Join(user.Dir(), "b"), make([]byte, 300), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Admit(user, 400, 0); err != nil {
+		t.Fatalf("the usage was walked again: %s", err)
+	}
+
+	q.Add(filepath.Join(user.Dir(), "b"), 300)
+	if err := q.Admit(user, 101, 0); err == nil {
+		t.Fatal("added bytes are not counted")
+	}
+
+	q.Add(filepath.Join(user.Dir(), "a"), -600)
+	if err := q.Admit(user, 700, 0); err != nil {
+		t.Fatalf("removed bytes are still counted: %s", err)
+	}
+
+	// bytes of another directory do not count
+	q.Add(filepath.Join(root.Dir(), "bob", "c"), 1000)
+	if err := q.Admit(user, 700, 0); err != nil {
+		t.Fatalf("bytes of another user are counted: %s", err)
+	}
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Root confines every path a client asks for to one directory on the server
+type Root struct {
+	dir string // absolute, symlinks resolved
+}
+
+func NewRoot(dir string) (*Root, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Root{dir: real}, nil
+}
+
+func (r *Root) Dir() string {
+	return r.dir
+}
+
+// Sub is the root of one user, a directory of its own under this root made on first use
+func (r *Root) Sub(name string) (*Root, error) {
+	local, err := r.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRoot(local)
+}
+
+// Resolve maps a slash separated path asked by the client to the local file system. It rejects absolute paths,
+// "..", device names and paths going through a symlink that points outside of the root.
+// The empty path and "." are the root itself.
+func (r *Root) Resolve(name string) (string, error) {
+	if name == "" || name == "." {
+		return r.dir, nil
+	}
+
+	if err := fileoperator.ValidName(name); err != nil {
+		return "", err
+	}
+
+	local := filepath.Join(r.dir, filepath.FromSlash(path.Clean(name)))
+	if !r.contains(local) {
+		return "", fmt.Errorf("%s: path escapes the storage root", name)
+	}
+
+	// the deepest part of the path that exists decides where the path really goes
+	for existing := local; ; existing = filepath.Dir(existing) {
+		real, err := filepath.EvalSymlinks(existing)
+		if os.IsNotExist(err) && existing != r.dir {
+			// a dangling symlink may point anywhere, writing through it would create its target
+			if _, linkErr := os.Lstat(existing); linkErr == nil {
+				return "", fmt.Errorf("%s: path goes through a dangling symlink", name)
+			}
+			continue
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, Cause(err))
+		}
+
+		if !r.contains(real) {
+			return "", fmt.Errorf("%s: path escapes the storage root", name)
+		}
+
+		if existing == local {
+			info, err := os.Stat(real)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", name, Cause(err))
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return "", fmt.Errorf("%s: not a regular file or directory", name)
+			}
+		}
+
+		return local, nil
+	}
+}
+
+// Name maps a local path inside the root back to the slash separated path the client knows
+func (r *Root) Name(local string) string {
+	rel, err := filepath.Rel(r.dir, local)
+	if err != nil {
+		return filepath.Base(local)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func (r *Root) contains(local string) bool {
+	rel, err := filepath.Rel(r.dir, local)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Cause drops the server side path from a file system error, the client only knows its own path
+func Cause(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err
+	}
+
+	return err
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	outside := t.TempDir()
+	root, err := NewRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := root.Dir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "a.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"escape":      outside,
+		"docs/parent": "..",
+		"docs/up":     "../..",
+		"inside":      "docs/old",
+		"dangling":    filepath.Join(outside, "missing"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, filepath.FromSlash(link))); err != nil {
+			t.Skip("cannot make symlinks:", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string // local path relative to the root, empty when rejected
+	}{
+		{"", "."},
+		{".", "."},
+		{"docs", "docs"},
+		{"docs/a.txt", "docs/a.txt"},
+		{"docs/new/b.txt", "docs/new/b.txt"},
+		{"docs/./a.txt", "docs/a.txt"},
+		{"docs//a.txt", "docs/a.txt"},
+		{"..", ""},
+		{"../x", ""},
+		{"docs/../..", ""},
+		{"docs/../a.txt", ""},
+		{"/etc/passwd", ""},
+		{"docs\\..\\..\\x", ""},
+		{"a\x00b", ""},
+		{"CON", ""},
+		{"docs/nul.txt", ""},
+		{"com1", ""},
+		{"LPT9.log", ""},
+		{"aux. ", ""},
+		{"COM10", "COM10"},
+		{"console", "console"},
+		{"escape", ""},
+		{"escape/x", ""},
+		{"dangling/x", ""},
+		{"docs/up/x", ""},
+		{"docs/parent/docs/a.txt", "docs/parent/docs/a.txt"},
+		{"inside/b.txt", "inside/b.txt"},
+	}
+	for _, test := range tests {
+		got, err := root.Resolve(test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %s, want an error", test.name, got)
+			}
+			continue
+		}
+
+		if want := filepath.Join(dir, filepath.FromSlash(test.want)); err != nil || got != want {
+			t.Errorf("Resolve(%q) = %s, %v, want %s", test.name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package storage
+
+// freeSpace is not known here, uploads are only checked against the quotas
+func freeSpace(dir string) (int64, error) {
+	return 0, errUnknownSpace
+}
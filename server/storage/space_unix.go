@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package storage
+
+import (
+	"syscall"
+)
+
+// freeSpace is how many bytes an unprivileged user may still write on the file system of dir
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/server/audit"
+	"github.com/gtxistxgao/safe-udp/server/auth"
+	"os"
+	"strings"
+)
+
+const toolsUsage = `Usage:
+  server passwd <user>   read a password on stdin, print the user file line letting the user in with it
+  server token <user>    make an API token, print it on stderr and the user file line letting it in on stdout
+  server audit-verify <key file> <log...>
+                         check the signatures of audit logs, given from the oldest to the newest
+`
+
+// tool runs the commands that make the lines of a user file or check the audit log, and returns the exit code
+func tool(name string, args []string) int {
+	if name == "audit-verify" {
+		return verifyAudit(args)
+	}
+
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, toolsUsage)
+		return 2
+	}
+	user := args[0]
+
+	switch name {
+	case "passwd":
+		fmt.Fprintln(os.Stderr, "Password:")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			fmt.Fprintln(os.Stderr, "no password given", err)
+			return 1
+		}
+
+		line, err := auth.HashPassword(user, password)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Println(line)
+	case "token":
+		token, line, err := auth.NewToken(user)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Fprintln(os.Stderr, "API token, give it to the user:", token)
+		fmt.Println(line)
+	default:
+		fmt.Fprint(os.Stderr, toolsUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// verifyAudit checks the chain of signatures through the audit logs, from the oldest one given
+func verifyAudit(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, toolsUsage)
+		return 2
+	}
+
+	key, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	previous := ""
+	for _, name := range args[1:] {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		previous, err = audit.Verify(file, key, previous)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			return 1
+		}
+	}
+
+	fmt.Println("The audit logs are intact")
+	return 0
+}
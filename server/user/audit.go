@@ -0,0 +1,78 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gtxistxgao/safe-udp/server/audit"
+	"log"
+	"path"
+	"time"
+)
+
+// record writes an entry of the session to the audit log
+func (u *User) record(e audit.Entry) {
+	e.Session, e.Remote = u.id, u.tcpConn.RemoteAddr()
+	if u.identity != nil {
+		e.User = u.identity.Name
+	}
+
+	if err := u.audit.Write(e); err != nil {
+		log.Println("Fail to write the audit log.", err)
+	}
+}
+
+// recordEnd writes the files of the transfer, if any, and the end of the session
+func (u *User) recordEnd(op string, started time.Time, err error) {
+	outcome := outcomeOf(err)
+	end := audit.Entry{Event: audit.EventEnd, Op: op, Duration: time.Since(started).Seconds(), Outcome: outcome}
+
+	if m := u.manifest; m != nil {
+		for _, f := range m.Files {
+			if f.IsDir() {
+				continue
+			}
+
+			fileOutcome := outcome
+			for _, name := range u.mismatched {
+				if name == f.Name {
+					fileOutcome = "checksum mismatch"
+				}
+			}
+
+			u.record(audit.Entry{Event: audit.EventFile, Op: op, Path: u.storedPath(f.Name), Size: f.Size, Digest: f.Checksum, Outcome: fileOutcome})
+		}
+
+		// every chunk of data beyond the files went more than once
+		end.Size = m.Size
+		if resent := int64(u.stats.DataBytes) - (m.Size - m.HoleSize()); resent > 0 {
+			end.Retransmits = resent
+		}
+	}
+
+	u.record(end)
+}
+
+// storedPath is the path within the storage root of a file of the transfer: where it landed for an upload, which
+// the conflict policy may have renamed, and the path asked for when it was never stored
+func (u *User) storedPath(name string) string {
+	if localPath, ok := u.stored[name]; ok {
+		return u.root.Name(localPath)
+	}
+
+	return path.Join(u.manifest.Dest, name)
+}
+
+// outcomeOf is how the audit log tells how something went
+func outcomeOf(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return "ok"
+}
+
+func sessionID() string {
+	buffer := make([]byte, 8)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,161 @@
+package user
+
+import (
+	"fmt"
+	"github.com/gtxistxgao/safe-udp/common/fileoperator"
+	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/server/policy"
+	"github.com/gtxistxgao/safe-udp/server/storage"
+	"log"
+	"os"
+	"path"
+)
+
+// resolve maps a path asked by the client to the server's file system, confined to the storage root
+func (u *User) resolve(name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+
+	return u.root.Resolve(name)
+}
+
+// authorize tells why the policy does not let the user do everything of permission with a resolved path
+func (u *User) authorize(permission policy.Permission, localPath string) error {
+	if u.identity == nil {
+		return nil
+	}
+
+	return u.policy.Check(u.identity.Name, permission, u.root.Name(localPath))
+}
+
+// resolveFor resolves a path the user may do everything of permission with
+func (u *User) resolveFor(permission policy.Permission, name string) (string, error) {
+	localPath, err := u.resolve(name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := u.authorize(permission, localPath); err != nil {
+		return "", err
+	}
+
+	return localPath, nil
+}
+
+// manage serves the file management requests, each of them is answered with a single message
+func (u *User) manage(request *model.Request, handle func(name string) (interface{}, error)) error {
+	var results []interface{}
+	for _, name := range request.Paths {
+		result, err := handle(name)
+		if err != nil {
+			u.tcpConn.SendError(err)
+			return err
+		}
+
+		results = append(results, result)
+	}
+
+	return u.tcpConn.SendResult(results)
+}
+
+// list answers the entries of a directory, or the file itself if it is not a directory
+func (u *User) list(name string) (interface{}, error) {
+	localPath, err := u.resolveFor(policy.List, name)
+	if err != nil {
+		return nil, err
+	}
+
+	name = u.root.Name(localPath)
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+	}
+
+	if !info.IsDir() {
+		return []model.FileStat{model.NewFileStat(name, info)}, nil
+	}
+
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+	}
+
+	stats := make([]model.FileStat, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			log.Println("Skip entry ", entry.Name(), err)
+			continue
+		}
+
+		stats = append(stats, model.NewFileStat(path.Join(name, entry.Name()), info))
+	}
+
+	return stats, nil
+}
+
+func (u *User) stat(name string) (interface{}, error) {
+	localPath, err := u.resolveFor(policy.List, name)
+	if err != nil {
+		return nil, err
+	}
+
+	name = u.root.Name(localPath)
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+	}
+
+	stat := model.NewFileStat(name, info)
+	if info.Mode().IsRegular() {
+		if stat.Checksum, err = fileoperator.Checksum(localPath); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+		}
+	}
+
+	return stat, nil
+}
+
+func (u *User) remove(name string, recursive bool) (interface{}, error) {
+	localPath, err := u.resolveFor(policy.Delete, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if localPath == u.root.Dir() {
+		return nil, fmt.Errorf("refuse to remove the storage root")
+	}
+
+	remove := os.Remove
+	if recursive {
+		remove = os.RemoveAll
+	}
+
+	// what the quota no longer counts, walking only what goes away
+	size, sizeErr := storage.Usage(localPath)
+	if err := remove(localPath); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+	}
+
+	if sizeErr == nil {
+		u.quota.Add(localPath, -size)
+	}
+
+	log.Printf("User %s removed %s\n", u.userInfo, name)
+	return name, nil
+}
+
+func (u *User) mkdir(name string) (interface{}, error) {
+	localPath, err := u.resolveFor(policy.Write, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, storage.Cause(err))
+	}
+
+	log.Printf("User %s created directory %s\n", u.userInfo, name)
+	return name, nil
+}
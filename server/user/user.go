@@ -1,378 +1,412 @@
 package user
 
 import (
-	"container/heap"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"github.com/gtxistxgao/safe-udp/common/consts"
 	"github.com/gtxistxgao/safe-udp/common/fileoperator"
 	"github.com/gtxistxgao/safe-udp/common/model"
+	"github.com/gtxistxgao/safe-udp/common/tcpconn"
+	"github.com/gtxistxgao/safe-udp/common/transfer"
+	"github.com/gtxistxgao/safe-udp/common/udp_client"
 	"github.com/gtxistxgao/safe-udp/common/udp_server"
-	"github.com/gtxistxgao/safe-udp/common/util"
-	"github.com/gtxistxgao/safe-udp/server/tcpconn"
+	"github.com/gtxistxgao/safe-udp/server/audit"
+	"github.com/gtxistxgao/safe-udp/server/auth"
+	"github.com/gtxistxgao/safe-udp/server/config"
+	"github.com/gtxistxgao/safe-udp/server/policy"
+	"github.com/gtxistxgao/safe-udp/server/session"
+	"github.com/gtxistxgao/safe-udp/server/storage"
 	"log"
-	"net"
 	"os"
-	"strconv"
-	"strings"
+	"path"
 	"time"
 )
 
+// Services are what the server shares between its users
+type Services struct {
+	Cfg      *config.Config
+	Sessions *session.Registry
+	Quota    *storage.Quota
+	Audit    *audit.Log      // nil when there is no audit log
+	Policy   *policy.Watcher // nil lets every user do anything within its root
+}
+
 type User struct {
-	ctx       context.Context
-	cancel    context.CancelFunc
-	userInfo  string
-	tcpConn   *tcpconn.TcpConn
-	udpServer *udp_server.UDPServer
-	fileInfo  fileoperator.FileMeta
-	progress  uint32 // progress donate the next packet index we are expecting
+	ctx      context.Context
+	cancel   context.CancelFunc
+	userInfo string
+	id       string // ties the audit log entries of the session together
+	tcpConn  *tcpconn.TcpConn
+	request  *model.Request
+	identity *auth.Identity // nil when the server lets anybody in
+	root     *storage.Root  // every path the user asks for is confined to it
+	policy   *policy.Watcher
+	quota    *storage.Quota
+	cfg      *config.Config
+	sessions *session.Registry
+	audit    *audit.Log
+
+	// what the transfer was about once it ran, for the audit log
+	manifest   *fileoperator.Manifest
+	stats      transfer.Stats
+	mismatched []string          // files whose checksum did not match after an upload
+	stored     map[string]string // where the files of the transfer are on the server, by their name in the manifest
 }
 
-func New(tcpConn net.Conn) *User {
+// New makes the user of a control connection whose request was read already, authenticated as identity
+func New(tcpConn *tcpconn.TcpConn, request *model.Request, identity *auth.Identity, root *storage.Root, services *Services) *User {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
-	server, err := udp_server.New(":0", 1024)
-	if err != nil {
-		log.Fatal("start udp server hit error: ", err)
+	userInfo := tcpConn.RemoteAddr()
+	if identity != nil {
+		userInfo = identity.Name + "@" + userInfo
 	}
 
 	return &User{
-		ctx:       ctx,
-		cancel:    cancel,
-		userInfo:  server.LocalAddr(),
-		udpServer: server,
-		tcpConn:   tcpconn.New(tcpConn),
-		progress:  0, // TODO: recording last time and support resuming
+		ctx:      ctx,
+		cancel:   cancel,
+		userInfo: userInfo,
+		id:       sessionID(),
+		tcpConn:  tcpConn,
+		request:  request,
+		identity: identity,
+		root:     root,
+		quota:    services.Quota,
+		cfg:      services.Cfg,
+		sessions: services.Sessions,
+		audit:    services.Audit,
+		policy:   services.Policy,
 	}
 }
 
+// Info tells who the user is
+func (u *User) Info() string {
+	return u.userInfo
+}
+
 func (u *User) Start() {
-	rawDataBufferCountLimit := (consts.MaxMemoryBufferMB * (1 << 20)) / consts.PayloadDataSizeByte
-	if rawDataBufferCountLimit > consts.PacketCountPerRound {
-		rawDataBufferCountLimit = consts.PacketCountPerRound
+	defer u.Close()
+
+	var err error
+	request := u.request
+	started := time.Now()
+	u.record(audit.Entry{Event: audit.EventStart, Op: request.Op, Paths: request.Paths})
+	switch request.Op {
+	case consts.OpPut:
+		err = u.put(request)
+	case consts.OpGet:
+		err = u.get(request)
+	case consts.OpList:
+		if len(request.Paths) == 0 {
+			request.Paths = []string{"."}
+		}
+		err = u.manage(request, u.list)
+	case consts.OpStat:
+		err = u.manage(request, u.stat)
+	case consts.OpRemove:
+		err = u.manage(request, func(name string) (interface{}, error) {
+			return u.remove(name, request.Recursive)
+		})
+	case consts.OpMkdir:
+		err = u.manage(request, u.mkdir)
+	default:
+		err = fmt.Errorf("unknown operation %q", request.Op)
+		u.tcpConn.SendError(err)
+	}
+
+	if err != nil {
+		log.Printf("User %s %s failed: %s\n", u.userInfo, request.Op, err)
+	} else {
+		fmt.Printf("User %s finished task\n", u.userInfo)
 	}
+	u.recordEnd(request.Op, started, err)
 
-	rawData := make(chan []byte, rawDataBufferCountLimit)
-	defer close(rawData)
+	if request.Op == consts.OpPut || request.Op == consts.OpGet {
+		// sleep 1 sec to cancel all go routines
+		time.Sleep(time.Second)
+	}
+}
 
-	// sync with client about the file
-	u.preSync()
+// put receives files from the user
+func (u *User) put(request *model.Request) (err error) {
+	if request.Resumable {
+		s, openErr := u.sessions.Open(u.tcpConn, u.identity)
+		if openErr != nil {
+			return openErr
+		}
+		defer func() { u.sessions.Close(s, err) }()
+	}
 
-	go u.serverWorker(u.ctx, rawData)
+	conflict, err := u.conflictPolicy(request.OnConflict)
+	if err != nil {
+		u.tcpConn.SendError(err)
+		return err
+	}
 
-	processedData := make(chan *model.Chunk, rawDataBufferCountLimit)
-	defer close(processedData)
+	if len(request.Sources) > consts.MaxSessionPaths {
+		err := fmt.Errorf("at most %d source addresses", consts.MaxSessionPaths)
+		u.tcpConn.SendError(err)
+		return err
+	}
 
-	for i := 0; i < consts.RawDataWorkerNumber; i++ {
-		go u.rawDataProcessWorker(u.ctx, rawData, processedData)
-		log.Println(i, " rawDataProcessWorker started")
+	// only the user may send chunks, from the address of its connection or the ones it told
+	guard, err := udp_server.NewGuard(append([]string{u.tcpConn.RemoteHost()}, request.Sources...)...)
+	if err != nil {
+		u.tcpConn.SendError(fmt.Errorf("fail to start UDP server"))
+		return err
 	}
 
-	dataToBeWritten := make(chan *model.Chunk, 1)
-	go u.minHeapWorker(u.ctx, processedData, dataToBeWritten)
-	log.Println("minHeapWorker started")
+	// behind a NAT the extra paths come from other addresses than the ones told, the token tells them
+	guard.Learn(len(request.Sources))
 
-	go u.saveToDiskWorker(u.ctx, dataToBeWritten, u.fileInfo.Name)
-	log.Println("saveToDiskWorker started")
+	u.tcpConn.OnMigrate(func() {
+		guard.Allow(append([]string{u.tcpConn.RemoteHost()}, request.Sources...)...)
+	})
 
-	u.tcpConn.SendPort("Server prepare ready\n") // tell client to start to send
+	servers, err := udp_server.Listen(":0", u.sockets(request.Sockets), consts.MaxChunkSize, guard)
+	if err != nil {
+		u.tcpConn.SendError(fmt.Errorf("fail to start UDP server"))
+		return err
+	}
+	defer closeServers(servers)
 
-	go u.sync()
+	// Tell user which UDP ports to send to
+	u.tcpConn.SendPorts(udp_server.Ports(servers), guard.Token())
 
-	select {
-	case <-u.ctx.Done():
-		fmt.Printf("User %s finished task\n", u.userInfo)
+	// Learn the files
+	manifest, err := u.tcpConn.GetManifest()
+	if err != nil {
+		u.tcpConn.SendError(err)
+		return err
+	}
+	u.manifest = manifest
+	log.Println("Got manifest", manifest.String())
+
+	dest, err := u.resolveManifest(manifest, conflict)
+	if err != nil {
+		u.tcpConn.SendError(err)
+		return err
+	}
+
+	// refuse what we cannot store before the user sends any of it
+	if err := u.quota.Admit(u.root, manifest.Size, manifest.Size-manifest.HoleSize()); err != nil {
+		u.tcpConn.SendError(storage.Cause(err))
+		return err
 	}
 
-	// sleep 1 sec to cancel all go routines
-	time.Sleep(time.Second)
+	writer, err := fileoperator.NewWriter(dest, manifest, conflict, u.ownership())
+	if err != nil {
+		u.tcpConn.SendError(err)
+		return err
+	}
+
+	receiver := transfer.NewReceiver(u.ctx, u.tcpConn, servers, manifest, writer, u.cfg.Workers)
+	u.tcpConn.SendReady() // tell client to start to send
+	err = receiver.Run()
+	u.stats, u.mismatched, u.stored = receiver.Stats(), writer.Mismatched(), writer.Stored()
+	u.quota.Add(dest, writer.Grown())
+	log.Println("Chunks", u.stats.String())
+	return err
 }
 
-func (u *User) sync() {
-	signal := make(chan *bool, 1)
-	go func() {
-		for {
-			sig := <-signal
-			if sig == nil {
-				break
-			}
-
-			message, err := u.tcpConn.Wait()
-			if err != nil {
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					log.Printf("Connection closed. Stop sync")
-					break
-				}
-			}
-
-			log.Printf("Message received from User %s\n", message)
-			u.triage(message)
-			signal <- util.BoolPtr(true)
+// get sends files to the user, the user listens to UDP and we emit
+func (u *User) get(request *model.Request) (err error) {
+	if request.Resumable {
+		s, openErr := u.sessions.Open(u.tcpConn, u.identity)
+		if openErr != nil {
+			return openErr
+		}
+		defer func() { u.sessions.Close(s, err) }()
+	}
+
+	paths := make([]string, 0, len(request.Paths))
+	for _, name := range request.Paths {
+		localPath, err := u.resolveFor(policy.Read, name)
+		if err != nil {
+			u.tcpConn.SendError(err)
+			return err
 		}
-	}()
 
-	signal <- util.BoolPtr(true)
+		paths = append(paths, localPath)
+	}
+
+	manifest, err := fileoperator.NewManifest(paths, chunkSize(request.ChunkSize))
+	if err != nil {
+		u.tcpConn.SendError(storage.Cause(err))
+		return err
+	}
 
-	select {
-	case <-u.ctx.Done():
-		for len(signal) > 0 {
-			<-signal
+	if request.Preserve {
+		if err := manifest.CollectMetadata(); err != nil {
+			u.tcpConn.SendError(storage.Cause(err))
+			return err
 		}
+	}
 
-		signal <- nil
-		log.Println("sync finished")
+	// we decide on compression, the manifest tells the client what we picked
+	if u.cfg.Compress && request.Compression == consts.CompressionDeflate {
+		manifest.Compression = request.Compression
 	}
-}
 
-func (u *User) triage(msg string) {
-	switch msg {
-	case "beat":
-		log.Println("The user is still there.")
-		break
-	case consts.Validate:
-		log.Println("User finished send all package. we need to do validation")
-		u.validate()
-		break
-	case "EOF":
-		log.Println("All Validation is done. Cleaning up")
-		u.Close()
-		break
-	case "finish":
-		log.Println("All Validation is done. Cleaning up")
-		u.Close()
-		break
+	if err := u.tcpConn.SendManifest(manifest); err != nil {
+		return err
+	}
+	u.manifest = manifest
+	u.stored = make(map[string]string, len(manifest.Files))
+	for _, f := range manifest.Files {
+		u.stored[f.Name] = f.LocalPath()
 	}
-}
 
-func (u *User) beat() {
-	log.Printf("The user %s alive\n", u.tcpConn.GetLocalInfo())
-}
+	ports, token, err := u.tcpConn.GetPorts()
+	if err != nil {
+		return err
+	}
 
-func (u *User) validate() {
-	finished := u.progress == u.fileInfo.TotalPacketCount
-	if finished {
-		log.Printf("All required %d packets received\n", u.progress)
-		// we can clean up  resources
-		u.tcpConn.SendFinishSignal()
-		u.Close()
-	} else {
-		// hay we are not finished yet. send me this packet again!
-		u.tcpConn.RequestPacket(u.progress)
+	if len(ports) > u.cfg.MaxSockets {
+		ports = ports[:u.cfg.MaxSockets]
+	}
+
+	path, err := u.dialPath(ports)
+	if err != nil {
+		return err
 	}
+
+	reader := fileoperator.NewReader(manifest, u.cfg.Read)
+	defer reader.Close()
+
+	sender := transfer.NewSender(u.ctx, u.tcpConn, []*transfer.Path{path}, token, reader, transfer.ModeMulti, request.Rate)
+	defer sender.Close()
+
+	// the user came back from another address, its UDP ports are the same
+	u.tcpConn.OnMigrate(func() {
+		path, err := u.dialPath(ports)
+		if err != nil {
+			log.Println("Fail to reach the user at its new address.", err)
+			return
+		}
+
+		sender.Migrate([]*transfer.Path{path})
+	})
+
+	err = sender.Run()
+	u.stats = sender.Stats()
+	return err
 }
 
-func (u *User) preSync() {
-	// Tell user which UDP port to send to
-	port := u.udpServer.GetPort()
-	log.Println("Tell client we are listening to this port", port)
-	u.tcpConn.SendPort(port) // tell user which UDP port to sent file
+// dialPath reaches the UDP ports of the user at its current address
+func (u *User) dialPath(ports []string) (*transfer.Path, error) {
+	udpClients, err := udp_client.DialAll(u.ctx, "", "", u.tcpConn.RemoteHost(), ports, time.Second*2)
+	if err != nil {
+		return nil, err
+	}
 
-	// Learn the file info
-	u.fileInfo = u.tcpConn.GetFileInfo()
-	log.Println("Got file info", u.fileInfo.String())
+	return &transfer.Path{Clients: udpClients}, nil
 }
 
-func (u *User) serverWorker(ctx context.Context, rawData chan []byte) {
-	if err := u.udpServer.Run(ctx, rawData); err != nil {
-		log.Fatal("Server Run hit error: ", err)
+// sockets is how many UDP sockets we open for an upload, what the user asks for within our limit
+func (u *User) sockets(asked int) int {
+	switch {
+	case asked <= 0:
+		return 1
+	case asked > u.cfg.MaxSockets:
+		return u.cfg.MaxSockets
 	}
+
+	return asked
 }
 
-func (u *User) Close() {
-	u.tcpConn.Close()
-	u.cancel()
+func closeServers(servers []*udp_server.UDPServer) {
+	for _, s := range servers {
+		s.Close()
+	}
 }
 
-func (u *User) rawDataProcessWorker(ctx context.Context, rawData chan []byte, processedData chan *model.Chunk) {
-	go func() {
-		for {
-			data := <-rawData
-			fmt.Println("Got raw data with size: ", len(data))
-			if data == nil {
-				break
-			}
-
-			sep := 0
-			for data[sep] != ',' {
-				sep++
-			}
-
-			indexStr := string(data[:sep])
-			index, err := strconv.ParseUint(indexStr, 10, 32)
-			if err != nil {
-				log.Println("Parse string to index hit error. String: ", indexStr, " Error: ", err)
-			}
-
-			encodedData := data[sep+1:]
-			unencodedData, err := base64.StdEncoding.DecodeString(string(encodedData))
-			if err != nil {
-				log.Println("Decode base64 hit error: ", err)
-			}
-
-			index32 := uint32(index)
-			c := model.Chunk{
-				Index: index32,
-				Data:  unencodedData,
-			}
-
-			log.Printf("Successfully processed data chunk %d and pushed into processedDataQueue.\n", index32)
-
-			processedData <- &c
-		}
-	}()
+// chunkSize keeps the chunk size the user found for its path MTU within what we support
+func chunkSize(asked int) int {
+	switch {
+	case asked == 0:
+		return consts.PayloadDataSizeByte
+	case asked < consts.MinPayloadDataSizeByte:
+		return consts.MinPayloadDataSizeByte
+	case asked > consts.MaxPayloadDataSizeByte:
+		return consts.MaxPayloadDataSizeByte
+	}
 
-	select {
-	case <-ctx.Done():
-		for len(rawData) > 0 {
-			<-rawData
+	return asked
+}
+
+// conflictPolicy picks the policy the user asked for, fail if none, as long as the server allows it
+func (u *User) conflictPolicy(name string) (fileoperator.ConflictPolicy, error) {
+	conflict := fileoperator.ConflictFail
+	if name != "" {
+		var err error
+		if conflict, err = fileoperator.ParseConflictPolicy(name); err != nil {
+			return "", err
 		}
+	}
 
-		rawData <- nil
-		fmt.Println("rawDataProcessWorker cancelled")
+	if !u.cfg.AllowConflictPolicy(conflict) {
+		return "", fmt.Errorf("conflict policy %s is not allowed by the server", conflict)
 	}
+
+	return conflict, nil
 }
 
-func (u *User) minHeapWorker(ctx context.Context, processedData chan *model.Chunk, dataToBeWritten chan *model.Chunk) {
-
-	go func() {
-		minHeapChunk := &model.MinHeapChunk{}
-		heap.Init(minHeapChunk)
-
-		for {
-			c := <-processedData
-			if c == nil {
-				fmt.Println("minHeapPushWorker routine finished")
-				break
-			}
-
-			heap.Push(minHeapChunk, *c)
-			fmt.Printf("pushed data chunk %d into min heap\n", c.Index)
-
-			if minHeapChunk.IsEmpty() {
-				log.Println("Nothing in the min heap")
-				continue
-			}
-
-			// remove duplicate package that we already processed
-			for top := minHeapChunk.Peek(); top.Index < u.progress; top = minHeapChunk.Peek() {
-				log.Println("Drop chunk with index: ", top.Index)
-				heap.Pop(minHeapChunk)
-				if minHeapChunk.IsEmpty() {
-					break
-				}
-			}
-
-			if minHeapChunk.IsEmpty() {
-				log.Println("Nothing in the min heap")
-				continue
-			}
-
-			topIndex := minHeapChunk.Peek().Index
-			if topIndex > u.progress {
-				log.Printf("Expect index %d, but top package %d.\n", u.progress, topIndex)
-				u.tcpConn.RequestPacket(u.progress)
-				fmt.Printf("Requested User send chunk %d. \n", u.progress)
-				continue
-			}
-
-			topOne := heap.Pop(minHeapChunk).(model.Chunk)
-			dataToBeWritten <- &topOne
-			u.progress++
-		}
-	}()
+// ownership is who the files the user uploads with their metadata may be given to: nobody unless the server
+// allows it, then the local account named like the user and the ids the server lists
+func (u *User) ownership() fileoperator.Ownership {
+	owners := fileoperator.Ownership{Uids: make(map[int]bool), Gids: make(map[int]bool)}
+	if !u.cfg.KeepOwner {
+		return owners
+	}
 
-	select {
-	case <-ctx.Done():
-		for len(processedData) > 0 {
-			<-processedData
-		}
+	for _, uid := range u.cfg.OwnerUids {
+		owners.Uids[uid] = true
+	}
+	for _, gid := range u.cfg.OwnerGids {
+		owners.Gids[gid] = true
+	}
 
-		processedData <- nil
-		fmt.Println("minHeapWorker cancelled")
+	if u.identity != nil {
+		owners.AllowAccount(u.identity.Name)
 	}
+
+	return owners
 }
 
-func (u *User) saveToDiskWorker(ctx context.Context, dataToBeWritten chan *model.Chunk, filePath string) {
-	go func(dataToBeWritten chan *model.Chunk) {
-		file, err := os.Create(filePath)
+// resolveManifest checks every file of an upload lands inside the storage root where the user may write, and may
+// delete the files it overwrites, and returns the local destination
+func (u *User) resolveManifest(manifest *fileoperator.Manifest, conflict fileoperator.ConflictPolicy) (string, error) {
+	dest, err := u.resolve(manifest.Dest)
+	if err != nil {
+		return "", err
+	}
+
+	if err := u.authorize(policy.Write, dest); err != nil {
+		return "", err
+	}
+
+	for _, f := range manifest.Files {
+		localPath, err := u.resolve(path.Join(manifest.Dest, f.Name))
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
-		defer func() {
-			if err := file.Close(); err != nil {
-				log.Println("Close file failed: ", err)
-			}
-		}()
-
-		for {
-			chunk := <-dataToBeWritten
-			if chunk == nil {
-				fmt.Println("minHeapPollWorker routine finished")
-				break
-			}
-
-			if n, writeErr := file.Write(chunk.Data); writeErr != nil {
-				u.tcpConn.RequestPacket(chunk.Index)
-				log.Printf("Fail to write index %d to disk. Ask user send it again. Error: %s", chunk.Index, writeErr)
-				continue
-			} else {
-				log.Printf("Write Chunk %d, %d bytes data into disk. Goal %d\n", chunk.Index, n, u.fileInfo.TotalPacketCount)
-
-			}
+		permission := policy.Write
+		if info, err := os.Stat(localPath); err == nil && !info.IsDir() && conflict == fileoperator.ConflictOverwrite {
+			permission |= policy.Delete
 		}
-	}(dataToBeWritten)
 
-	select {
-	case <-ctx.Done():
-		for len(dataToBeWritten) > 0 {
-			<-dataToBeWritten
+		if err := u.authorize(permission, localPath); err != nil {
+			return "", err
 		}
-
-		dataToBeWritten <- nil
-		fmt.Println("saveToDiskWorker cancelled")
 	}
+
+	return dest, nil
 }
 
-//func jumpWriteWorker(ctx context.Context, processedData chan *model.Chunk, filePath string) {
-//	go func(processedData chan *model.Chunk) {
-//		file, err := os.Create(filePath)
-//		if err != nil {
-//			log.Fatal(err)
-//		}
-//
-//		defer func() {
-//			if err := file.Close(); err != nil {
-//				log.Println("Close file failed: ", err)
-//			}
-//		}()
-//
-//		for {
-//			data := <-processedData
-//			if data == nil {
-//				fmt.Println("jumpWriteWorker routine finished")
-//				break
-//			}
-//
-//			offset := int64(consts.PayloadDataSize * data.Index)
-//			if n, writeErr := file.WriteAt(data.Data, offset); writeErr != nil {
-//				log.Println("Write data to disk error: ", writeErr)
-//				break
-//			} else {
-//				log.Printf("Chunk Index %d, %d bytes saved.\n", data.Index, n)
-//			}
-//		}
-//	}(processedData)
-//
-//	select {
-//	case <-ctx.Done():
-//		for len(processedData) > 0 {
-//			<-processedData
-//		}
-//
-//		processedData <- nil
-//		fmt.Println("jumpWriteWorker cancelled")
-//	}
-//}
+func (u *User) Close() {
+	u.tcpConn.Close()
+	u.cancel()
+}